@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+const accountDeletionInterval = time.Minute
+
+// Accounts are only marked for deletion by REQUEST_DELETE_ACCOUNT,
+// the actual deletion happens here once the grace period is over
+func accountDeletionThread() {
+	for range time.Tick(accountDeletionInterval) {
+		now := time.Now().UnixNano()
+
+		userIds, err := db.GetUsersToDelete(now)
+		if err != nil {
+			log.Println("Could not get users to delete: ", err.Error())
+			continue
+		}
+
+		for _, userId := range userIds {
+			if deleted, err := deleteAccount(userId, now); err != nil {
+				log.Printf("Could not delete user %d: %s", userId, err.Error())
+			} else if deleted {
+				log.Printf("Deleted user %d", userId)
+			}
+		}
+	}
+}
+
+// Deletion that was cancelled in the meantime is skipped and false is returned
+func deleteAccount(userId uint64, ts int64) (bool, error) {
+	if deleted, err := db.DeleteUser(context.Background(), userId, ts); err != nil || !deleted {
+		return false, err
+	}
+
+	err := os.Remove(filepath.Join(config.Conf.AvatarDir, avatarPath(int(userId))))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove avatar of user %d: %s", userId, err.Error())
+	}
+
+	if err := session.DeleteUserSessions(userId, ""); err != nil {
+		log.Printf("Could not delete sessions of user %d: %s", userId, err.Error())
+	}
+
+	events.EventsFlow <- &events.ControlEvent{
+		EvType: events.EVENT_SESSION_REVOKED,
+		Info:   &events.InternalEventSessionRevoked{UserId: userId},
+	}
+
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/handlers"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+const (
+	apiPrefix = "/api/v1/"
+
+	defaultMaxRequestSize = 1 << 20
+)
+
+func maxRequestSize() int {
+	if config.Conf.MaxRequestSize == 0 {
+		return defaultMaxRequestSize
+	}
+
+	return config.Conf.MaxRequestSize
+}
+
+// get_messages, GET_MESSAGES and REQUEST_GET_MESSAGES all mean REQUEST_GET_MESSAGES
+func apiRequestType(path string) string {
+	reqType := strings.ToUpper(strings.Trim(strings.TrimPrefix(path, apiPrefix), "/"))
+	if !strings.HasPrefix(reqType, "REQUEST_") {
+		reqType = "REQUEST_" + reqType
+	}
+
+	return reqType
+}
+
+var apiErrorStatuses = map[string]int{
+	protocol.ERROR_INVALID_ARGUMENT:    http.StatusBadRequest,
+	protocol.ERROR_NOT_FOUND:           http.StatusNotFound,
+	protocol.ERROR_ALREADY_EXISTS:      http.StatusConflict,
+	protocol.ERROR_UNAUTHENTICATED:     http.StatusUnauthorized,
+	protocol.ERROR_PERMISSION_DENIED:   http.StatusForbidden,
+	protocol.ERROR_FAILED_PRECONDITION: http.StatusPreconditionFailed,
+	protocol.ERROR_RATE_LIMITED:        http.StatusTooManyRequests,
+	protocol.ERROR_DEADLINE_EXCEEDED:   http.StatusGatewayTimeout,
+	// nginx uses it for "client closed request"
+	protocol.ERROR_CANCELLED: 499,
+}
+
+func apiErrorStatus(code string) int {
+	if status, ok := apiErrorStatuses[code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeAPIReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Could not send JSON: " + err.Error())
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, e *protocol.ResponseError) {
+	writeAPIReply(w, apiErrorStatus(e.Code), e.ToReply(0))
+}
+
+// APIHandler serves the same requests as websocket: POST /api/v1/get_messages with JSON
+// of protocol.RequestGetMessages in the body returns protocol.ReplyMessagesList
+func APIHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIReply(w, http.StatusMethodNotAllowed, protocol.NewReplyError(0, protocol.ERROR_INVALID_ARGUMENT, "Only POST requests are supported"))
+		return
+	}
+
+	userInfo := authenticateRequest(req)
+	if userInfo == nil {
+		writeAPIError(w, &protocol.ResponseError{Code: protocol.ERROR_UNAUTHENTICATED, UserMsg: "You must provide API token or session cookie"})
+		return
+	}
+
+	// Browsers send cookies with cross-site forms too, but they cannot send JSON
+	// to other sites without CORS preflight, which we do not allow
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); userInfo.TokenId == 0 && mediaType != "application/json" {
+		writeAPIReply(w, http.StatusUnsupportedMediaType, protocol.NewReplyError(0, protocol.ERROR_INVALID_ARGUMENT, "Content-Type must be application/json"))
+		return
+	}
+
+	reqType := apiRequestType(req.URL.Path)
+
+	userReq, err := handlers.NewRequest(reqType)
+	if err != nil {
+		writeAPIError(w, &protocol.ResponseError{Code: protocol.ERROR_NOT_FOUND, UserMsg: "Invalid request type: " + reqType})
+		return
+	}
+
+	// Empty body is the same as {}
+	err = json.NewDecoder(http.MaxBytesReader(w, req.Body, int64(maxRequestSize()))).Decode(userReq.Data)
+	if err != nil && err != io.EOF {
+		writeAPIError(w, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Cannot decode request: " + err.Error()})
+		return
+	}
+
+	emailVerified, err := db.IsEmailVerified(req.Context(), userInfo.Id)
+	if err != nil {
+		log.Println("Could not get email verification status: ", err.Error())
+	}
+
+	reqCtx, cancel := context.WithTimeout(req.Context(), handlers.RequestTimeout())
+	defer cancel()
+
+	ctx := &handlers.WebsocketCtx{
+		UserId:        userInfo.Id,
+		UserName:      userInfo.Name,
+		SessionId:     userInfo.SessionId,
+		IP:            clientIP(req),
+		SiteURL:       siteURL(),
+		TokenId:       userInfo.TokenId,
+		Scopes:        userInfo.Scopes,
+		EmailVerified: emailVerified,
+		Context:       reqCtx,
+	}
+
+	resp := ctx.Dispatch(userReq)
+	if v, ok := resp.(*protocol.ResponseError); ok {
+		writeAPIError(w, v)
+		return
+	}
+
+	writeAPIReply(w, http.StatusOK, resp)
+}
+
+// ProtocolSchemaHandler serves JSON Schema of requests, replies and events for client developers
+func ProtocolSchemaHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.Write(handlers.ProtocolSchema())
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+func TestAPIRequestType(t *testing.T) {
+	for _, path := range []string{"/api/v1/get_messages", "/api/v1/GET_MESSAGES", "/api/v1/REQUEST_GET_MESSAGES", "/api/v1/get_messages/"} {
+		if res := apiRequestType(path); res != "REQUEST_GET_MESSAGES" {
+			t.Fatalf("Unexpected request type for %q: %q", path, res)
+		}
+	}
+}
+
+func TestAPIErrorStatus(t *testing.T) {
+	cases := map[string]int{
+		protocol.ERROR_INVALID_ARGUMENT: http.StatusBadRequest,
+		protocol.ERROR_RATE_LIMITED:     http.StatusTooManyRequests,
+		protocol.ERROR_INTERNAL:         http.StatusInternalServerError,
+		"":                              http.StatusInternalServerError,
+	}
+
+	for code, status := range cases {
+		if res := apiErrorStatus(code); res != status {
+			t.Errorf("Unexpected status for %q: %d instead of %d", code, res, status)
+		}
+	}
+}
@@ -8,15 +8,76 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
+const (
+	EMAIL_VERIFICATION_OFF      = ""
+	EMAIL_VERIFICATION_LOGIN    = "login"
+	EMAIL_VERIFICATION_RESTRICT = "restrict"
+)
+
 type (
 	Config struct {
 		Postgresql string
 		Memcache   string
 		Bind       string
 		BindTLS    string
-		Host       string
 		AvatarDir  string
 		CertDir    string
+
+		// Public host name of the site, e.g. "vbambuke.ru". Links in emails are built from it
+		// and only websocket connections from pages of this host are accepted, so it is required.
+		Host string
+
+		// Where sessions are kept: "memcache" (default), "memory" or "sql"
+		SessionStore string
+
+		// Session lifetime in seconds since last use, 30 days when not set
+		SessionTTL int
+
+		// HMAC keys for cookies, the first one is used for signing and the rest are
+		// still accepted so that keys can be rotated without logging everyone out
+		CookieKeys []string
+
+		// How emails are delivered: "smtp" or "file" (default), which writes them
+		// to MailFile or to stdout when MailFile is empty
+		Mailer       string
+		MailFrom     string
+		MailFile     string
+		SMTPAddr     string
+		SMTPUser     string
+		SMTPPassword string
+
+		// What unverified users cannot do: "" lets them do everything, "login" does
+		// not let them log in and "restrict" forbids sending messages, adding friends
+		// and posting to timeline
+		EmailVerification string
+
+		// How long deleted accounts can still be restored, 7 days when not set
+		AccountDeletionGraceHours int
+
+		// How many requests of one websocket connection can be processed at the same time, 8 when not set
+		MaxInFlightRequests int
+
+		// How long a request can run before its db queries are cancelled, 30 seconds when not set
+		RequestTimeoutSeconds int
+
+		// Max size of one websocket or HTTP API request in bytes, 1MB when not set
+		MaxRequestSize int
+
+		// Weighted requests per second for one websocket connection and for all connections
+		// and HTTP API requests of one user, 20 and 50 when not set. Twice as many requests
+		// can be made at once.
+		RequestsPerSecond     int
+		UserRequestsPerSecond int
+
+		// How often EVENT_PING is sent to websocket clients, 30 seconds when not set.
+		// Clients that do not send anything for two intervals are disconnected.
+		PingIntervalSeconds int
+
+		// Websocket connections without requests are closed after this time, never when not set
+		IdleTimeoutMinutes int
+
+		// bcrypt cost for password hashes, bcrypt.DefaultCost is used when not set
+		PasswordCost int
 	}
 )
 
@@ -40,4 +101,8 @@ func ParseConfig(path string) {
 	if _, err = toml.Decode(string(contents), &Conf); err != nil {
 		log.Fatal("Could not parse config: " + err.Error())
 	}
+
+	if Conf.Host == "" {
+		log.Fatal("Host must be set in config")
+	}
 }
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/handlers"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/ratelimit"
+	"github.com/YuriyNasretdinov/social-net/session"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultMaxInFlightRequests = 8
+	defaultPingInterval        = 30 * time.Second
+
+	// Client that cannot receive a frame for this long is as good as dead
+	writeTimeout = 10 * time.Second
+
+	// Marks request that must not run concurrently with others: "REQUEST_SEND_MESSAGE 5 ordered\n{...}"
+	orderedFlag = "ordered"
+
+	// Requests that wait for a free worker or for an ordered request. When the queue is full,
+	// new requests get RATE_LIMITED, so that reader never waits and still sees REQUEST_CANCEL.
+	maxQueuedRequests = 64
+
+	// Client is disconnected when it keeps making requests after it got RATE_LIMITED:
+	// it can get this many such errors at once and one more every 10 seconds
+	maxRateLimitViolations       = 10
+	rateLimitViolationsPerSecond = 0.1
+)
+
+var errRequestTooLarge = errors.New("Request is too large")
+
+// requestReader fails when a single request gets bigger than the limit. Websocket frames
+// are limited too, but a request can be split into many small frames.
+type requestReader struct {
+	r     io.Reader
+	read  int
+	limit int
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	if r.read >= r.limit {
+		return 0, errRequestTooLarge
+	}
+
+	if len(p) > r.limit-r.read {
+		p = p[:r.limit-r.read]
+	}
+
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+// Reader is buffered, so the limit is only precise up to the buffer size
+func (r *requestReader) reset() {
+	r.read = 0
+}
+
+// queuedRequest is a request that was read, but is not processed yet
+type queuedRequest struct {
+	ctx     context.Context
+	reqType string
+	seqId   int
+	ordered bool
+	data    json.RawMessage
+}
+
+// wsConnection is a single /events connection. Requests are read one by one and processed
+// concurrently, replies are matched with requests by SeqId on the client.
+// Reader only reads frames and puts requests into the queue, dispatcher takes them from
+// the queue in order and waits for the locks, so control frames are never stuck behind requests.
+type wsConnection struct {
+	ws       *websocket.Conn
+	userInfo *session.SessionInfo
+	recvChan chan interface{}
+
+	ip            string
+	emailVerified bool
+	versionParam  string
+
+	// Reader can switch the version after REQUEST_HELLO while writer is sending events
+	adapter atomic.Value
+
+	// Ordered requests take write lock, see dispatchLoop
+	orderMu sync.RWMutex
+	// Limits the number of requests being processed at the same time
+	inFlight chan struct{}
+	queue    chan *queuedRequest
+
+	// Cancelled when the socket is closed, parent of all request contexts
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Requests that are being processed by seq id, for REQUEST_CANCEL
+	cancelsMu sync.Mutex
+	cancels   map[int]context.CancelFunc
+
+	rateLimit *ratelimit.Bucket
+	// Runs out when client ignores RATE_LIMITED errors
+	violations *ratelimit.Bucket
+
+	// Unix nano time of the last request other than REQUEST_PONG, for the idle timeout
+	lastRequestTs int64
+}
+
+func maxInFlightRequests() int {
+	if config.Conf.MaxInFlightRequests == 0 {
+		return defaultMaxInFlightRequests
+	}
+
+	return config.Conf.MaxInFlightRequests
+}
+
+func pingInterval() time.Duration {
+	if config.Conf.PingIntervalSeconds == 0 {
+		return defaultPingInterval
+	}
+
+	return time.Duration(config.Conf.PingIntervalSeconds) * time.Second
+}
+
+func idleTimeout() time.Duration {
+	return time.Duration(config.Conf.IdleTimeoutMinutes) * time.Minute
+}
+
+func newWsConnection(ws *websocket.Conn, userInfo *session.SessionInfo, versionParam string, adapter handlers.ProtocolAdapter) *wsConnection {
+	c := &wsConnection{
+		ws:            ws,
+		userInfo:      userInfo,
+		recvChan:      make(chan interface{}, 100),
+		versionParam:  versionParam,
+		inFlight:      make(chan struct{}, maxInFlightRequests()),
+		queue:         make(chan *queuedRequest, maxQueuedRequests),
+		cancels:       make(map[int]context.CancelFunc),
+		rateLimit:     handlers.NewConnectionRateLimit(),
+		violations:    ratelimit.NewBucket(rateLimitViolationsPerSecond, maxRateLimitViolations),
+		lastRequestTs: time.Now().UnixNano(),
+	}
+
+	ws.MaxPayloadBytes = maxRequestSize()
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.adapter.Store(adapter)
+	return c
+}
+
+func (c *wsConnection) currentAdapter() handlers.ProtocolAdapter {
+	return c.adapter.Load().(handlers.ProtocolAdapter)
+}
+
+// Header line is "<request type> <seq id>[ <flags>]\n"
+func readHeader(rd *bufio.Reader) (reqType string, seqId int, ordered bool, err error) {
+	reqType, err = rd.ReadString(' ')
+	if err != nil {
+		return "", 0, false, fmt.Errorf("Could not read request type from client: %s", err.Error())
+	}
+
+	reqType = reqType[:len(reqType)-1]
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", 0, false, fmt.Errorf("Could not read seq id string: %s", err.Error())
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", 0, false, fmt.Errorf("Sequence id is missing")
+	}
+
+	seqId, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("Sequence id is not int: %s", err.Error())
+	}
+
+	for _, flag := range fields[1:] {
+		if flag == orderedFlag {
+			ordered = true
+		}
+	}
+
+	return reqType, seqId, ordered, nil
+}
+
+func (c *wsConnection) readLoop() {
+	defer func() {
+		log.Println("User ", c.userInfo.Name, " disconnected")
+		c.cancel()
+		c.ws.Close()
+	}()
+
+	go c.dispatchLoop()
+
+	//	dupReader := io.TeeReader(ws, os.Stdout)
+	limiter := &requestReader{r: c.ws, limit: maxRequestSize()}
+	rd := bufio.NewReader(limiter)
+	decoder := json.NewDecoder(rd)
+
+	for first := true; ; first = false {
+		limiter.reset()
+
+		// Client answers EVENT_PING, so nothing for two intervals means that the connection is dead
+		c.ws.SetReadDeadline(time.Now().Add(2 * pingInterval()))
+
+		reqType, seqId, ordered, err := readHeader(rd)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			if err == errRequestTooLarge || err == websocket.ErrFrameTooLarge {
+				log.Printf("Disconnecting %s: %s", c.userInfo.Name, err.Error())
+				return
+			}
+
+			sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Cannot decode request: " + err.Error()})
+			continue
+		}
+
+		if reqType == "REQUEST_HELLO" {
+			if !first || c.versionParam != "" {
+				sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_FAILED_PRECONDITION, UserMsg: "Protocol version can only be negotiated once and before other requests"})
+				continue
+			}
+
+			// Client cannot understand anything else we say, so the connection is closed right away
+			if !c.hello(seqId, data) {
+				return
+			}
+			continue
+		}
+
+		if reqType == "REQUEST_PONG" {
+			continue
+		}
+
+		atomic.StoreInt64(&c.lastRequestTs, time.Now().UnixNano())
+
+		// Seq id is the one of the request to cancel, the frame body is ignored
+		if reqType == "REQUEST_CANCEL" {
+			c.cancelRequest(seqId)
+			continue
+		}
+
+		// Registered before the next frame is read, so that REQUEST_CANCEL always finds it,
+		// even when the request is still in the queue
+		reqCtx, ok := c.startRequest(seqId)
+		if !ok {
+			sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Request with this seq id is already being processed"})
+			continue
+		}
+
+		req := &queuedRequest{ctx: reqCtx, reqType: reqType, seqId: seqId, ordered: ordered, data: data}
+
+		select {
+		case c.queue <- req:
+		default:
+			c.finishRequest(seqId)
+			sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_RATE_LIMITED, UserMsg: "Too many requests are waiting to be processed"})
+		}
+	}
+}
+
+// dispatchLoop starts queued requests in the order they were read. Ordered requests take
+// write lock, so they wait for all requests before them and all requests after them wait for them.
+func (c *wsConnection) dispatchLoop() {
+	for {
+		var req *queuedRequest
+
+		select {
+		case req = <-c.queue:
+		case <-c.ctx.Done():
+			return
+		}
+
+		if req.ordered {
+			c.orderMu.Lock()
+		} else {
+			c.orderMu.RLock()
+		}
+
+		c.inFlight <- struct{}{}
+
+		go func() {
+			defer func() {
+				c.finishRequest(req.seqId)
+				<-c.inFlight
+
+				if req.ordered {
+					c.orderMu.Unlock()
+				} else {
+					c.orderMu.RUnlock()
+				}
+			}()
+
+			c.process(req.ctx, req.reqType, req.seqId, req.data)
+		}()
+	}
+}
+
+// Version is switched synchronously so that all following requests use the new adapter
+func (c *wsConnection) hello(seqId int, data json.RawMessage) bool {
+	req := new(protocol.RequestHello)
+	if err := json.Unmarshal(data, req); err != nil {
+		c.recvChan <- protocol.NewReplyError(seqId, protocol.ERROR_INVALID_ARGUMENT, "Cannot decode request: "+err.Error())
+		return false
+	}
+
+	hello, errResp := (&handlers.WebsocketCtx{SeqId: seqId}).ProcessHello(req)
+	if errResp != nil {
+		c.recvChan <- errResp.ToReply(seqId)
+		return false
+	}
+
+	hello.SetSeqId(seqId)
+
+	adapter, _ := handlers.AdapterForVersion(hello.Version)
+	c.adapter.Store(adapter)
+
+	c.recvChan <- hello
+	return true
+}
+
+// Seq id identifies the request for REQUEST_CANCEL and the reply, so it cannot be reused
+// until the request with the same seq id finishes: ok is false in that case
+func (c *wsConnection) startRequest(seqId int) (ctx context.Context, ok bool) {
+	c.cancelsMu.Lock()
+	defer c.cancelsMu.Unlock()
+
+	if _, exists := c.cancels[seqId]; exists {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, handlers.RequestTimeout())
+	c.cancels[seqId] = cancel
+
+	return ctx, true
+}
+
+func (c *wsConnection) finishRequest(seqId int) {
+	c.cancelsMu.Lock()
+	cancel, ok := c.cancels[seqId]
+	delete(c.cancels, seqId)
+	c.cancelsMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// Request that has already finished cannot be cancelled, so unknown seq ids are ignored
+func (c *wsConnection) cancelRequest(seqId int) {
+	c.cancelsMu.Lock()
+	cancel, ok := c.cancels[seqId]
+	c.cancelsMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+func (c *wsConnection) process(reqCtx context.Context, reqType string, seqId int, data json.RawMessage) {
+	adapter := c.currentAdapter()
+
+	reqType, data, err := adapter.AdaptRequest(reqType, data)
+	if err != nil {
+		sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: err.Error()})
+		return
+	}
+
+	userReq, err := handlers.NewRequest(reqType)
+	if err != nil {
+		sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_NOT_FOUND, UserMsg: "Invalid request type: " + reqType})
+		return
+	}
+
+	if err := json.Unmarshal(data, userReq.Data); err != nil {
+		sendError(seqId, c.recvChan, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Cannot decode request: " + err.Error()})
+		return
+	}
+
+	ctx := &handlers.WebsocketCtx{
+		SeqId:         seqId,
+		UserId:        c.userInfo.Id,
+		Listener:      c.recvChan,
+		UserName:      c.userInfo.Name,
+		SessionId:     c.userInfo.SessionId,
+		IP:            c.ip,
+		SiteURL:       siteURL(),
+		TokenId:       c.userInfo.TokenId,
+		Scopes:        c.userInfo.Scopes,
+		Adapter:       adapter,
+		EmailVerified: c.emailVerified,
+		RateLimit:     c.rateLimit,
+		Context:       reqCtx,
+	}
+
+	resp := ctx.Dispatch(userReq)
+	if v, ok := resp.(*protocol.ResponseError); ok {
+		sendError(seqId, c.recvChan, v)
+
+		if v.Code == protocol.ERROR_RATE_LIMITED && !c.violations.Take(1) {
+			log.Printf("Disconnecting %s for exceeding rate limit", c.userInfo.Name)
+			c.ws.Close()
+		}
+		return
+	}
+
+	resp.SetSeqId(seqId)
+	events.EventsFlow <- &events.ControlEvent{
+		EvType:   events.EVENT_USER_REPLY,
+		Listener: c.recvChan,
+		Reply:    resp,
+	}
+}
+
+// Writer stops when the reader stops or when dispatcher sends nil to disconnect the client
+func (c *wsConnection) writeLoop() {
+	ticker := time.NewTicker(pingInterval())
+	defer ticker.Stop()
+
+	for {
+		var ev interface{}
+
+		select {
+		case ev = <-c.recvChan:
+			if ev == nil {
+				return
+			}
+		case now := <-ticker.C:
+			lastRequest := time.Unix(0, atomic.LoadInt64(&c.lastRequestTs))
+			if idleTimeout() > 0 && now.Sub(lastRequest) > idleTimeout() {
+				log.Printf("Disconnecting %s after %s without requests", c.userInfo.Name, now.Sub(lastRequest))
+				return
+			}
+
+			ping := new(events.EventPing)
+			ping.Type = "EVENT_PING"
+			ping.Ts = fmt.Sprint(now.UnixNano())
+			ev = ping
+		case <-c.ctx.Done():
+			return
+		}
+
+		c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		if err := websocket.JSON.Send(c.ws, c.currentAdapter().AdaptReply(ev)); err != nil {
+			fmt.Println("Could not send JSON: " + err.Error())
+			return
+		}
+	}
+}
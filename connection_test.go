@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	cases := []struct {
+		in      string
+		reqType string
+		seqId   int
+		ordered bool
+		fail    bool
+	}{
+		{in: "REQUEST_GET_FRIENDS 3\n", reqType: "REQUEST_GET_FRIENDS", seqId: 3},
+		{in: "REQUEST_SEND_MESSAGE 5 ordered\n", reqType: "REQUEST_SEND_MESSAGE", seqId: 5, ordered: true},
+		{in: "REQUEST_SEND_MESSAGE 6 unknown\n", reqType: "REQUEST_SEND_MESSAGE", seqId: 6},
+		{in: "REQUEST_SEND_MESSAGE x\n", fail: true},
+		{in: "REQUEST_SEND_MESSAGE \n", fail: true},
+		{in: "REQUEST_SEND_MESSAGE", fail: true},
+	}
+
+	for _, c := range cases {
+		reqType, seqId, ordered, err := readHeader(bufio.NewReader(strings.NewReader(c.in)))
+		if c.fail {
+			if err == nil {
+				t.Errorf("%q: expected error", c.in)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", c.in, err.Error())
+			continue
+		}
+
+		if reqType != c.reqType || seqId != c.seqId || ordered != c.ordered {
+			t.Errorf("%q: got %s %d %v", c.in, reqType, seqId, ordered)
+		}
+	}
+}
+
+func TestRequestReader(t *testing.T) {
+	r := &requestReader{r: strings.NewReader("0123456789"), limit: 4}
+
+	buf := make([]byte, 10)
+	if n, err := r.Read(buf); n != 4 || err != nil {
+		t.Fatalf("Unexpected read: %d, %v", n, err)
+	}
+
+	if _, err := r.Read(buf); err != errRequestTooLarge {
+		t.Fatalf("Expected request too large error, got %v", err)
+	}
+
+	r.reset()
+	if n, err := r.Read(buf); n != 4 || err != nil || string(buf[:n]) != "4567" {
+		t.Fatalf("Limit must be reset for the next request: %d, %v", n, err)
+	}
+}
+
+func TestStartRequestDuplicate(t *testing.T) {
+	c := &wsConnection{cancels: make(map[int]context.CancelFunc)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+
+	first, ok := c.startRequest(1)
+	if !ok {
+		t.Fatalf("First request must be started")
+	}
+
+	if _, ok := c.startRequest(1); ok {
+		t.Fatalf("Request with the seq id that is in flight must be rejected")
+	}
+
+	c.finishRequest(1)
+	if first.Err() == nil {
+		t.Fatalf("Context must be cancelled when request finishes")
+	}
+
+	second, ok := c.startRequest(1)
+	if !ok || second.Err() != nil {
+		t.Fatalf("Seq id must be reusable after the request finishes")
+	}
+}
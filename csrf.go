@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/session"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	csrfCookieName = "csrf"
+	csrfFieldName  = "csrf_token"
+	csrfTokenBytes = 16
+)
+
+var errCSRF = errors.New("Form has expired, please go back, reload the page and try again")
+
+// Double-submit token: the same signed random value is kept in a cookie and in every form.
+// Other sites cannot read the cookie of our user, so they cannot put the right value into a form.
+// The token is not tied to the session and anyone can get a valid one for themselves, so it
+// does not help against attackers that can set cookies for our host, e.g. from a subdomain.
+// Must be called before anything is written to w because it can set the cookie.
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if cook, err := req.Cookie(csrfCookieName); err == nil {
+		if _, ok := session.Unsign(cook.Value); ok {
+			return cook.Value
+		}
+	}
+
+	buf := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		log.Println("Could not generate CSRF token: ", err.Error())
+		return ""
+	}
+
+	token := session.Sign(hex.EncodeToString(buf))
+	setAuthCookie(w, req, csrfCookieName, token, time.Time{})
+
+	return token
+}
+
+// serveFormPage renders a page with a form that only needs the CSRF token
+func serveFormPage(tpl *template.Template, w http.ResponseWriter, req *http.Request) {
+	data := &struct{ CSRFToken string }{CSRFToken: csrfToken(w, req)}
+	if err := tpl.Execute(w, data); err != nil {
+		log.Println("Could not render template: " + err.Error())
+	}
+}
+
+// checkCSRF must be used by all handlers that change state on POST from HTML forms
+func checkCSRF(req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return errCSRF
+	}
+
+	cook, err := req.Cookie(csrfCookieName)
+	if err != nil {
+		return errCSRF
+	}
+
+	if _, ok := session.Unsign(cook.Value); !ok {
+		return errCSRF
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cook.Value), []byte(req.PostFormValue(csrfFieldName))) != 1 {
+		return errCSRF
+	}
+
+	return nil
+}
+
+// Pages from other sites must not be able to open websocket with cookies of our users.
+// Only config.Conf.Host is allowed, Host header of the request can be anything.
+func allowedOrigin(origin *url.URL) bool {
+	if origin == nil {
+		return false
+	}
+
+	return (origin.Scheme == "http" || origin.Scheme == "https") && origin.Host == config.Conf.Host
+}
+
+func websocketHandshake(conf *websocket.Config, req *http.Request) error {
+	var err error
+
+	conf.Origin, err = websocket.Origin(conf, req)
+	if err != nil {
+		return err
+	}
+
+	// Browsers cannot set Authorization header for websocket, so API clients do not need the check
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	if !allowedOrigin(conf.Origin) {
+		log.Printf("Websocket connection from %s rejected: origin %v is not allowed", clientIP(req), conf.Origin)
+		return errors.New("Origin is not allowed")
+	}
+
+	return nil
+}
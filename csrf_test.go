@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	config.Conf.SessionStore = session.STORE_MEMORY
+	session.InitSession()
+
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatalf("CSRF cookie is not set correctly: %q, %v", token, cookies)
+	}
+
+	newReq := func(method, formToken string, cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(method, "/login", strings.NewReader(url.Values{csrfFieldName: {formToken}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	if err := checkCSRF(newReq("POST", token, cookies[0])); err != nil {
+		t.Fatalf("Valid token rejected: %s", err.Error())
+	}
+
+	forged := &http.Cookie{Name: csrfCookieName, Value: "abc.def"}
+	invalid := []*http.Request{
+		newReq("GET", token, cookies[0]),
+		newReq("POST", "", cookies[0]),
+		newReq("POST", token, nil),
+		newReq("POST", token+"x", cookies[0]),
+		newReq("POST", forged.Value, forged),
+	}
+
+	for i, req := range invalid {
+		if err := checkCSRF(req); err == nil {
+			t.Fatalf("Request %d must be rejected", i)
+		}
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	defer func(host string) { config.Conf.Host = host }(config.Conf.Host)
+
+	check := func(origin string, expected bool) {
+		u, err := url.Parse(origin)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %s", origin, err.Error())
+		}
+
+		if res := allowedOrigin(u); res != expected {
+			t.Fatalf("Unexpected result for %q with host %q: %v", origin, config.Conf.Host, res)
+		}
+	}
+
+	config.Conf.Host = "vbambuke.ru"
+	check("https://vbambuke.ru", true)
+	check("http://vbambuke.ru", true)
+	check("http://localhost:8080", false)
+	check("https://vbambuke.ru.evil.org", false)
+	check("/", false)
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+// Order matters: hashtimeline rows are found through timeline and socialuser goes last
+// so that a failed deletion can simply be retried.
+// Messages that the user sent to others stay in their mailboxes, but they no longer
+// point to an existing user.
+var deleteUserQueries = []string{
+	`DELETE FROM hashtimeline WHERE timeline_id IN(SELECT id FROM timeline WHERE source_user_id = $1)`,
+	`DELETE FROM timeline WHERE user_id = $1 OR source_user_id = $1`,
+	`DELETE FROM messages WHERE user_id = $1`,
+	`DELETE FROM friend WHERE user_id = $1 OR friend_user_id = $1`,
+	`DELETE FROM userinfo WHERE user_id = $1`,
+	`DELETE FROM recoverycode WHERE user_id = $1`,
+	`DELETE FROM securityevent WHERE user_id = $1`,
+	`DELETE FROM apitoken WHERE user_id = $1`,
+	`DELETE FROM socialuser WHERE id = $1`,
+}
+
+// DeleteUser erases all rows that belong to the user in a single transaction if the user
+// is still scheduled for deletion before ts. Nothing is deleted and false is returned
+// when the deletion was cancelled after the user got into GetUsersToDelete.
+func DeleteUser(ctx context.Context, userId uint64, ts int64) (deleted bool, err error) {
+	err = crdb.ExecuteTx(ctx, Db, nil, func(tx *sql.Tx) error {
+		deleted = false
+
+		var id uint64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM socialuser
+			WHERE id = $1 AND delete_after > 0 AND delete_after < $2
+			FOR UPDATE`, userId, ts).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, q := range deleteUserQueries {
+			if _, err := tx.ExecContext(ctx, q, userId); err != nil {
+				return err
+			}
+		}
+
+		deleted = true
+		return nil
+	})
+
+	return deleted, err
+}
+
+// GetUsersToDelete returns users whose deletion grace period ended before ts
+func GetUsersToDelete(ts int64) (userIds []uint64, err error) {
+	rows, err := GetUsersToDeleteStmt.Query(ts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		userIds = append(userIds, id)
+	}
+
+	return userIds, rows.Err()
+}
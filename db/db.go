@@ -2,6 +2,7 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"log"
 	"strconv"
@@ -16,8 +17,16 @@ type (
 		Lat  float64
 	}
 
+	LoginInfo struct {
+		Id            uint64
+		Password      string
+		Name          string
+		EmailVerified bool
+		TotpEnabled   bool
+	}
+
 	Querier interface {
-		Query(query string, args ...interface{}) (*sql.Rows, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 	}
 )
 
@@ -33,6 +42,42 @@ var (
 	// Registration
 	RegisterStmt *sql.Stmt
 
+	// Password
+	GetPasswordStmt    *sql.Stmt
+	UpdatePasswordStmt *sql.Stmt
+
+	// Email verification
+	GetEmailVerifiedStmt *sql.Stmt
+	VerifyEmailStmt      *sql.Stmt
+	GetEmailStmt         *sql.Stmt
+	GetCredentialsStmt   *sql.Stmt
+	ChangeEmailStmt      *sql.Stmt
+
+	// Two-factor authentication
+	GetTotpStmt             *sql.Stmt
+	SetTotpSecretStmt       *sql.Stmt
+	EnableTotpStmt          *sql.Stmt
+	DisableTotpStmt         *sql.Stmt
+	UseTotpStepStmt         *sql.Stmt
+	AddRecoveryCodeStmt     *sql.Stmt
+	UseRecoveryCodeStmt     *sql.Stmt
+	DeleteRecoveryCodesStmt *sql.Stmt
+
+	// Security events
+	AddSecurityEventStmt  *sql.Stmt
+	GetSecurityEventsStmt *sql.Stmt
+
+	// API tokens
+	AddApiTokenStmt    *sql.Stmt
+	GetApiTokenStmt    *sql.Stmt
+	GetApiTokensStmt   *sql.Stmt
+	TouchApiTokenStmt  *sql.Stmt
+	DeleteApiTokenStmt *sql.Stmt
+
+	// Account deletion
+	ScheduleDeletionStmt *sql.Stmt
+	GetUsersToDeleteStmt *sql.Stmt
+
 	// Messages
 	GetMessagesStmt      *sql.Stmt
 	SendMessageStmt      *sql.Stmt
@@ -76,8 +121,55 @@ func prepareStmt(db *sql.DB, stmt string) *sql.Stmt {
 //language=PostgreSQL
 func InitStmts() {
 	TestStmt = prepareStmt(Db, "SELECT MAX(id) FROM socialuser")
-	LoginStmt = prepareStmt(Db, "SELECT id, password, name FROM socialuser WHERE email = $1")
-	RegisterStmt = prepareStmt(Db, "INSERT INTO socialuser(email, password, name, have_avatar) VALUES($1, $2, $3, false) RETURNING id")
+	LoginStmt = prepareStmt(Db, "SELECT id, password, name, email_verified, totp_enabled FROM socialuser WHERE email = $1")
+	RegisterStmt = prepareStmt(Db, "INSERT INTO socialuser(email, password, name, have_avatar, email_verified) VALUES($1, $2, $3, false, false) RETURNING id")
+	GetPasswordStmt = prepareStmt(Db, "SELECT password FROM socialuser WHERE id = $1")
+	UpdatePasswordStmt = prepareStmt(Db, "UPDATE socialuser SET password = $1 WHERE id = $2")
+	GetEmailVerifiedStmt = prepareStmt(Db, "SELECT email_verified FROM socialuser WHERE id = $1")
+	VerifyEmailStmt = prepareStmt(Db, "UPDATE socialuser SET email_verified = true WHERE id = $1 AND email = $2")
+	GetEmailStmt = prepareStmt(Db, "SELECT email FROM socialuser WHERE id = $1")
+	GetCredentialsStmt = prepareStmt(Db, "SELECT email, password FROM socialuser WHERE id = $1")
+	ChangeEmailStmt = prepareStmt(Db, "UPDATE socialuser SET email = $1, email_verified = true WHERE id = $2 AND email = $3 AND password = $4")
+
+	GetTotpStmt = prepareStmt(Db, "SELECT totp_secret, totp_enabled FROM socialuser WHERE id = $1")
+	SetTotpSecretStmt = prepareStmt(Db, "UPDATE socialuser SET totp_secret = $1 WHERE id = $2 AND totp_enabled = false")
+	EnableTotpStmt = prepareStmt(Db, "UPDATE socialuser SET totp_enabled = true, totp_last_step = $2 WHERE id = $1")
+	DisableTotpStmt = prepareStmt(Db, "UPDATE socialuser SET totp_secret = '', totp_enabled = false, totp_last_step = 0 WHERE id = $1")
+	UseTotpStepStmt = prepareStmt(Db, "UPDATE socialuser SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2")
+	AddRecoveryCodeStmt = prepareStmt(Db, "INSERT INTO recoverycode(user_id, code_hash) VALUES($1, $2)")
+	UseRecoveryCodeStmt = prepareStmt(Db, "DELETE FROM recoverycode WHERE user_id = $1 AND code_hash = $2 RETURNING id")
+	DeleteRecoveryCodesStmt = prepareStmt(Db, "DELETE FROM recoverycode WHERE user_id = $1")
+
+	AddSecurityEventStmt = prepareStmt(Db, `INSERT INTO securityevent
+		(user_id, event_type, ip, ts)
+		VALUES($1, $2, $3, $4)`)
+
+	GetSecurityEventsStmt = prepareStmt(Db, `SELECT event_type, ip, ts
+		FROM securityevent
+		WHERE user_id = $1
+		ORDER BY ts DESC
+		LIMIT $2`)
+
+	AddApiTokenStmt = prepareStmt(Db, `INSERT INTO apitoken
+		(user_id, name, token_hash, scopes, created_ts, last_used_ts)
+		VALUES($1, $2, $3, $4, $5, 0)
+		RETURNING id`)
+
+	GetApiTokenStmt = prepareStmt(Db, `SELECT t.id, t.user_id, t.scopes, u.name
+		FROM apitoken AS t
+		JOIN socialuser AS u ON u.id = t.user_id
+		WHERE t.token_hash = $1`)
+
+	GetApiTokensStmt = prepareStmt(Db, `SELECT id, name, scopes, created_ts, last_used_ts
+		FROM apitoken
+		WHERE user_id = $1
+		ORDER BY id`)
+
+	TouchApiTokenStmt = prepareStmt(Db, `UPDATE apitoken SET last_used_ts = $1 WHERE id = $2`)
+	DeleteApiTokenStmt = prepareStmt(Db, `DELETE FROM apitoken WHERE id = $1 AND user_id = $2`)
+
+	ScheduleDeletionStmt = prepareStmt(Db, `UPDATE socialuser SET delete_after = $1 WHERE id = $2`)
+	GetUsersToDeleteStmt = prepareStmt(Db, `SELECT id FROM socialuser WHERE delete_after > 0 AND delete_after < $1`)
 	GetFriendsList = prepareStmt(Db, `SELECT friend_user_id FROM friend WHERE user_id = $1 AND request_accepted = true`)
 	GetFriendsCount = prepareStmt(Db, `SELECT COUNT(*) FROM friend WHERE user_id = $1 AND request_accepted = true`)
 	GetFriendsRequestList = prepareStmt(Db, `SELECT friend_user_id FROM friend WHERE user_id = $1 AND request_accepted = false`)
@@ -150,11 +242,11 @@ func InitStmts() {
 }
 
 // user id is string for simplicity
-func GetUserNames(userIds []string) (map[string]string, error) {
+func GetUserNames(ctx context.Context, userIds []string) (map[string]string, error) {
 	userNames := make(map[string]string)
 
 	if len(userIds) > 0 {
-		rows, err := Db.Query(`SELECT id, name FROM socialuser WHERE id IN(` + strings.Join(userIds, ",") + `)`)
+		rows, err := Db.QueryContext(ctx, `SELECT id, name FROM socialuser WHERE id IN(`+strings.Join(userIds, ",")+`)`)
 		if err != nil {
 			return nil, err
 		}
@@ -221,10 +313,10 @@ func INuint(values []uint64) string {
 	return string(b)
 }
 
-func GetCityInfo(id uint64) (*City, error) {
+func GetCityInfo(ctx context.Context, id uint64) (*City, error) {
 	res := new(City)
 	res.Id = id
-	row := GetCityInfoStmt.QueryRow(res.Id)
+	row := GetCityInfoStmt.QueryRowContext(ctx, res.Id)
 	err := row.Scan(&res.Name, &res.Lon, &res.Lat)
 	if err != nil {
 		return nil, err
@@ -232,9 +324,9 @@ func GetCityInfo(id uint64) (*City, error) {
 	return res, nil
 }
 
-func GetCityInfoByName(name string) (*City, error) {
+func GetCityInfoByName(ctx context.Context, name string) (*City, error) {
 	res := new(City)
-	row := GetCityInfoByNameStmt.QueryRow(name)
+	row := GetCityInfoByNameStmt.QueryRowContext(ctx, name)
 	err := row.Scan(&res.Id, &res.Name, &res.Lon, &res.Lat)
 	if err != nil {
 		return nil, err
@@ -242,21 +334,36 @@ func GetCityInfoByName(name string) (*City, error) {
 	return res, nil
 }
 
-func GetUserFriendsCount(userId uint64) (cnt uint64, err error) {
-	err = GetFriendsCount.QueryRow(userId).Scan(&cnt)
+// GetLoginInfo returns sql.ErrNoRows when there is no user with such email
+func GetLoginInfo(ctx context.Context, email string) (*LoginInfo, error) {
+	res := new(LoginInfo)
+	err := LoginStmt.QueryRowContext(ctx, email).Scan(&res.Id, &res.Password, &res.Name, &res.EmailVerified, &res.TotpEnabled)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func IsEmailVerified(ctx context.Context, userId uint64) (verified bool, err error) {
+	err = GetEmailVerifiedStmt.QueryRowContext(ctx, userId).Scan(&verified)
+	return
+}
+
+func GetUserFriendsCount(ctx context.Context, userId uint64) (cnt uint64, err error) {
+	err = GetFriendsCount.QueryRowContext(ctx, userId).Scan(&cnt)
 	return
 }
 
-func GetUserFriends(userId uint64) (userIds []uint64, err error) {
-	return getUsersByStmt(userId, GetFriendsList)
+func GetUserFriends(ctx context.Context, userId uint64) (userIds []uint64, err error) {
+	return getUsersByStmt(ctx, userId, GetFriendsList)
 }
 
-func GetUserFriendsRequests(userId uint64) (userIds []uint64, err error) {
-	return getUsersByStmt(userId, GetFriendsRequestList)
+func GetUserFriendsRequests(ctx context.Context, userId uint64) (userIds []uint64, err error) {
+	return getUsersByStmt(ctx, userId, GetFriendsRequestList)
 }
 
-func IsUserFriend(userId, friendId uint64) (isFriend, requestAccepted bool, err error) {
-	row := GetRequestedAcceptedForFriend.QueryRow(friendId, userId)
+func IsUserFriend(ctx context.Context, userId, friendId uint64) (isFriend, requestAccepted bool, err error) {
+	row := GetRequestedAcceptedForFriend.QueryRowContext(ctx, friendId, userId)
 	err = row.Scan(&requestAccepted)
 
 	if err == sql.ErrNoRows {
@@ -268,8 +375,8 @@ func IsUserFriend(userId, friendId uint64) (isFriend, requestAccepted bool, err
 	return true, requestAccepted, nil
 }
 
-func getUsersByStmt(userId uint64, stmt *sql.Stmt) (userIds []uint64, err error) {
-	res, err := stmt.Query(userId)
+func getUsersByStmt(ctx context.Context, userId uint64, stmt *sql.Stmt) (userIds []uint64, err error) {
+	res, err := stmt.QueryContext(ctx, userId)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type (
+	ExportProfile struct {
+		Name           string
+		Email          string
+		Birthdate      string `json:",omitempty"`
+		Sex            int    `json:",omitempty"`
+		Description    string `json:",omitempty"`
+		CityName       string `json:",omitempty"`
+		FamilyPosition int    `json:",omitempty"`
+	}
+
+	ExportMessage struct {
+		IsOut bool
+		Text  string
+		Ts    int64
+	}
+
+	ExportPost struct {
+		Text     string
+		Ts       int64
+		Hashtags []string
+	}
+)
+
+// The functions below are used for personal data export and pass rows to the callback
+// one by one so that the whole history of the user is never loaded into memory
+
+// GetExportProfile returns account info along with userinfo and city when they are filled in
+func GetExportProfile(ctx context.Context, userId uint64) (*ExportProfile, error) {
+	res := new(ExportProfile)
+
+	err := Db.QueryRowContext(ctx, `SELECT name, email FROM socialuser WHERE id = $1`, userId).Scan(&res.Name, &res.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		birthdate time.Time
+		cityId    uint64
+	)
+
+	err = GetProfileStmt.QueryRowContext(ctx, userId).Scan(&res.Name, &birthdate, &res.Sex, &res.Description, &cityId, &res.FamilyPosition)
+	if err == sql.ErrNoRows {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res.Birthdate = birthdate.Format("2006-01-02")
+
+	if city, err := GetCityInfo(ctx, cityId); err == nil {
+		res.CityName = city.Name
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ExportMessages calls cb for every message of the user, grouped by conversation and ordered by time
+func ExportMessages(ctx context.Context, userId uint64, cb func(userTo uint64, msg *ExportMessage) error) error {
+	rows, err := Db.QueryContext(ctx, `SELECT user_id_to, is_out, message, ts
+		FROM messages
+		WHERE user_id = $1
+		ORDER BY user_id_to, ts`, userId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			userTo uint64
+			msg    ExportMessage
+		)
+
+		if err = rows.Scan(&userTo, &msg.IsOut, &msg.Text, &msg.Ts); err != nil {
+			return err
+		}
+
+		if err = cb(userTo, &msg); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ExportPosts calls cb for every timeline post written by the user, ordered by time.
+// Hashtags are linked to just one of the fan-out copies of a post, so they are matched by author and ts.
+func ExportPosts(ctx context.Context, userId uint64, cb func(post *ExportPost) error) error {
+	rows, err := Db.QueryContext(ctx, `SELECT t.message, t.ts, h.name
+		FROM timeline AS t
+		LEFT JOIN (
+			SELECT ht.ts, hs.name
+			FROM hashtimeline AS ht
+			JOIN timeline AS s ON s.id = ht.timeline_id
+			JOIN hashes AS hs ON hs.id = ht.hash_id
+			WHERE s.source_user_id = $1
+		) AS h ON h.ts = t.ts
+		WHERE t.user_id = $1 AND t.source_user_id = $1
+		ORDER BY t.ts`, userId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var post *ExportPost
+
+	for rows.Next() {
+		var (
+			text string
+			ts   int64
+			hash sql.NullString
+		)
+
+		if err = rows.Scan(&text, &ts, &hash); err != nil {
+			return err
+		}
+
+		if post != nil && post.Ts != ts {
+			if err = cb(post); err != nil {
+				return err
+			}
+			post = nil
+		}
+
+		if post == nil {
+			post = &ExportPost{Text: text, Ts: ts, Hashtags: make([]string, 0)}
+		}
+
+		if hash.Valid {
+			post.Hashtags = append(post.Hashtags, hash.String)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if post != nil {
+		return cb(post)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/handlers"
+)
+
+// Sends verification link if user with such email exists and has not confirmed it yet
+func sendVerificationLink(email string) error {
+	info, err := getLoginInfo(email)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.EmailVerified {
+		return nil
+	}
+
+	return handlers.SendVerificationEmail(handlers.VERIFICATION_REGISTER, siteURL(), info.Id, info.Name, email, "")
+}
+
+func VerifyEmailHandler(w http.ResponseWriter, req *http.Request) {
+	kind, userId, email, stamp, ok := handlers.ParseVerificationToken(req.URL.Query().Get("token"))
+	if !ok {
+		w.Header().Add("Content-type", "text/html; charset=UTF-8")
+		fmt.Fprintf(w, "The link is invalid or has expired. <a href='/resend-verification'>Request a new one</a>")
+		return
+	}
+
+	var err error
+	if kind == handlers.VERIFICATION_CHANGE_EMAIL {
+		ok, err = handlers.ConfirmEmailChange(req.Context(), userId, stamp, email)
+	} else {
+		_, err = db.VerifyEmailStmt.Exec(userId, email)
+	}
+
+	if err == nil && !ok {
+		w.Header().Add("Content-type", "text/html; charset=UTF-8")
+		fmt.Fprintf(w, "The link is no longer valid because your email or password has changed since it was sent. <a href='/'>Go to login page</a>")
+		return
+	} else if isUniqueViolation(err) {
+		fmt.Fprintf(w, "This email is already used by another account")
+		return
+	} else if err != nil {
+		log.Println("Could not verify email: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to confirm your email")
+		return
+	}
+
+	w.Header().Add("Content-type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "Your email has been confirmed! <a href='/'>Go to login page</a>")
+}
+
+func ResendVerificationHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		serveFormPage(resendVerificationTpl, w, req)
+		return
+	}
+
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	req.ParseForm()
+	email := req.Form.Get("email")
+
+	if email == "" {
+		fmt.Fprintf(w, "You must provide email")
+		return
+	}
+
+	if err := sendVerificationLink(email); err != nil {
+		log.Println("Could not send verification link: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to send you an email")
+		return
+	}
+
+	w.Header().Add("Content-type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "If this email is registered and not confirmed yet, we have sent a new link to it. <a href='/'>Go to login page</a>")
+}
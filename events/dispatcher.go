@@ -1,8 +1,10 @@
 package events
 
 import (
+	"expvar"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/YuriyNasretdinov/social-net/protocol"
 	"github.com/YuriyNasretdinov/social-net/session"
@@ -16,11 +18,23 @@ const (
 	EVENT_NEW_MESSAGE
 	EVENT_NEW_TIMELINE_EVENT
 	EVENT_FRIEND_REQUEST
+	EVENT_SESSION_REVOKED
+
+	// Listener whose channel stays full for this long is disconnected
+	slowListenerTimeout = 10 * time.Second
+	// Slow listeners are also checked without new events, so that they get EVENT_RESYNC
+	// or are disconnected even when nothing else is sent to them
+	slowListenerCheckInterval = time.Second
+	// Listener that has this many replies waiting for room in its channel is disconnected
+	maxPendingReplies = 100
 )
 
 type (
 	BaseEvent struct {
 		Type string
+		// Set for events of the user that are replayed after reconnect with last_event_id,
+		// ids only grow for every user
+		EventId uint64 `json:",string,omitempty"`
 	}
 
 	ControlEvent struct {
@@ -28,6 +42,8 @@ type (
 		Info     interface{}
 		Reply    interface{}
 		Listener chan interface{}
+		// For EVENT_USER_CONNECTED: id of the last event that client got before reconnect
+		LastEventId uint64
 	}
 
 	EventUserConnected struct {
@@ -40,9 +56,12 @@ type (
 		protocol.JSUserInfo
 	}
 
+	// Sent first on connect. LastEventId is the id of the last event of the user, so that
+	// clients know what to pass as last_event_id even if there were no events yet.
 	EventOnlineUsersList struct {
 		BaseEvent
-		Users []protocol.JSUserInfo
+		Users       []protocol.JSUserInfo
+		LastEventId uint64 `json:",string"`
 	}
 
 	EventNewMessage struct {
@@ -68,6 +87,31 @@ type (
 		protocol.TimelineMessage
 	}
 
+	EventSessionRevoked struct {
+		BaseEvent
+	}
+
+	// Client must answer with "REQUEST_PONG <seq id>\n{}" or it is disconnected
+	EventPing struct {
+		BaseEvent
+		Ts string
+	}
+
+	// Client has missed some events and must reload everything it shows
+	EventResync struct {
+		BaseEvent
+	}
+
+	// Either SessionId or TokenId is set to revoke single session or API token,
+	// ExceptSessionId revokes all other sessions of the user but keeps API tokens,
+	// otherwise all sessions and tokens of the user are revoked
+	InternalEventSessionRevoked struct {
+		UserId          uint64
+		SessionId       string
+		TokenId         uint64
+		ExceptSessionId string
+	}
+
 	InternalEventNewTimelineStatus struct {
 		UserId        uint64
 		FriendUserIds []uint64
@@ -79,8 +123,137 @@ type (
 
 var (
 	EventsFlow = make(chan *ControlEvent, 200)
+
+	// Events that clients can receive, used to describe the protocol
+	ClientEvents = map[string]interface{}{
+		"EVENT_USER_CONNECTED":     EventUserConnected{},
+		"EVENT_USER_DISCONNECTED":  EventUserDisconnected{},
+		"EVENT_ONLINE_USERS_LIST":  EventOnlineUsersList{},
+		"EVENT_NEW_MESSAGE":        EventNewMessage{},
+		"EVENT_NEW_TIMELINE_EVENT": EventNewTimelineStatus{},
+		"EVENT_FRIEND_REQUEST":     EventFriendRequest{},
+		"EVENT_SESSION_REVOKED":    EventSessionRevoked{},
+		"EVENT_PING":               EventPing{},
+		"EVENT_RESYNC":             EventResync{},
+	}
+
+	// Exported at /debug/vars
+	droppedEvents             = expvar.NewInt("events_dropped")
+	disconnectedSlowListeners = expvar.NewInt("slow_listeners_disconnected")
+
+	// When the first event was dropped for listeners that missed events.
+	// Only used from EventsDispatcher goroutine.
+	slowListeners = make(map[chan interface{}]time.Time)
+
+	// Replies that did not fit into the channel of a slow listener, in the order they were sent.
+	// Only used from EventsDispatcher goroutine.
+	pendingReplies = make(map[chan interface{}][]interface{})
 )
 
+func newResyncEvent() *EventResync {
+	ev := new(EventResync)
+	ev.Type = "EVENT_RESYNC"
+	return ev
+}
+
+// sendEvent never blocks the dispatcher. When the listener is not fast enough to read events,
+// they are dropped and the listener gets EVENT_RESYNC once it catches up, or it is disconnected
+// if it does not catch up for slowListenerTimeout, see checkSlowListener.
+func sendEvent(listener chan interface{}, ev interface{}) {
+	if checkSlowListener(listener, time.Now()) {
+		droppedEvents.Add(1)
+		return
+	}
+
+	select {
+	case listener <- ev:
+		return
+	default:
+	}
+
+	slowListeners[listener] = time.Now()
+	droppedEvents.Add(1)
+}
+
+// sendReply is like sendEvent, but replies are never dropped: the client waits for them and
+// cannot get them back with resync. Replies that do not fit are kept in pendingReplies until
+// the listener catches up, or the listener is disconnected.
+func sendReply(listener chan interface{}, reply interface{}) {
+	checkSlowListener(listener, time.Now())
+
+	if len(pendingReplies[listener]) == 0 {
+		select {
+		case listener <- reply:
+			return
+		default:
+		}
+	}
+
+	if _, slow := slowListeners[listener]; !slow {
+		slowListeners[listener] = time.Now()
+	}
+
+	pendingReplies[listener] = append(pendingReplies[listener], reply)
+	if len(pendingReplies[listener]) > maxPendingReplies {
+		log.Printf("Disconnecting listener that has %d replies pending", len(pendingReplies[listener]))
+		disconnectSlowListener(listener)
+	}
+}
+
+// Pending replies go first, so that they are not overtaken by the replies sent after them
+func flushPendingReplies(listener chan interface{}) {
+	replies := pendingReplies[listener]
+	for len(replies) > 0 && len(listener) < cap(listener) {
+		listener <- replies[0]
+		replies = replies[1:]
+	}
+
+	if len(replies) == 0 {
+		delete(pendingReplies, listener)
+	} else {
+		pendingReplies[listener] = replies
+	}
+}
+
+func disconnectSlowListener(listener chan interface{}) {
+	disconnectedSlowListeners.Add(1)
+	delete(slowListeners, listener)
+	delete(pendingReplies, listener)
+	disconnectListener(listener, newResyncEvent())
+}
+
+// checkSlowListener sends pending replies and EVENT_RESYNC to the slow listener that has caught up
+// or disconnects the one that has not for too long. It returns whether events for the listener
+// must still be dropped.
+func checkSlowListener(listener chan interface{}, now time.Time) bool {
+	since, slow := slowListeners[listener]
+	if !slow {
+		return false
+	}
+
+	flushPendingReplies(listener)
+
+	// there must be room for the next event too, otherwise the client would resync and miss it anyway
+	if len(pendingReplies[listener]) == 0 && cap(listener)-len(listener) >= 2 {
+		listener <- newResyncEvent()
+		delete(slowListeners, listener)
+		return false
+	}
+
+	if now.Sub(since) > slowListenerTimeout {
+		log.Printf("Disconnecting listener that has not read events for %s", now.Sub(since))
+		disconnectSlowListener(listener)
+	}
+
+	return true
+}
+
+func checkSlowListeners(now time.Time) {
+	for listener := range slowListeners {
+		checkSlowListener(listener, now)
+	}
+}
+
 func handleUserConnected(listenerMap map[chan interface{}]*session.SessionInfo, userListeners map[uint64]map[chan interface{}]bool, ev *ControlEvent) {
 	evInfo, ok := ev.Info.(*session.SessionInfo)
 	if !ok {
@@ -93,11 +266,29 @@ func handleUserConnected(listenerMap map[chan interface{}]*session.SessionInfo,
 		currentUsers = append(currentUsers, protocol.JSUserInfo{Name: info.Name, Id: fmt.Sprint(info.Id)})
 	}
 
+	stream, ok := userStreams[evInfo.Id]
+	if !ok {
+		stream = newUserStream()
+		userStreams[evInfo.Id] = stream
+	}
+	stream.disconnectedTs = time.Time{}
+
 	ouEvent := new(EventOnlineUsersList)
 	ouEvent.Type = "EVENT_ONLINE_USERS_LIST"
 	ouEvent.Users = currentUsers
+	ouEvent.LastEventId = stream.lastId
 	ev.Listener <- ouEvent
 
+	if ev.LastEventId != 0 {
+		if missed, ok := stream.since(ev.LastEventId); ok {
+			for _, e := range missed {
+				sendEvent(ev.Listener, e)
+			}
+		} else {
+			sendEvent(ev.Listener, newResyncEvent())
+		}
+	}
+
 	listenerMap[ev.Listener] = evInfo
 
 	if userListeners[evInfo.Id] == nil {
@@ -107,15 +298,11 @@ func handleUserConnected(listenerMap map[chan interface{}]*session.SessionInfo,
 	userListeners[evInfo.Id][ev.Listener] = true
 
 	for listener := range listenerMap {
-		if len(listener) >= cap(listener) {
-			return
-		}
-
 		event := new(EventUserConnected)
 		event.Type = "EVENT_USER_CONNECTED"
 		event.Name = evInfo.Name
 		event.Id = fmt.Sprint(evInfo.Id)
-		listener <- event
+		sendEvent(listener, event)
 	}
 }
 
@@ -127,23 +314,27 @@ func handleUserDisconnected(listenerMap map[chan interface{}]*session.SessionInf
 	}
 
 	delete(listenerMap, ev.Listener)
+	delete(slowListeners, ev.Listener)
+	delete(pendingReplies, ev.Listener)
 	if userListeners[evInfo.Id] != nil {
 		delete(userListeners[evInfo.Id], ev.Listener)
 		if len(userListeners[evInfo.Id]) == 0 {
 			delete(userListeners, evInfo.Id)
+
+			if stream, ok := userStreams[evInfo.Id]; ok {
+				stream.disconnectedTs = time.Now()
+			}
 		}
 	}
 
-	for listener := range listenerMap {
-		if len(listener) >= cap(listener) {
-			return
-		}
+	sweepUserStreams(time.Now())
 
+	for listener := range listenerMap {
 		event := new(EventUserDisconnected)
 		event.Type = "EVENT_USER_DISCONNECTED"
 		event.Name = evInfo.Name
 		event.Id = fmt.Sprint(evInfo.Id)
-		listener <- event
+		sendEvent(listener, event)
 	}
 }
 
@@ -159,33 +350,18 @@ func handleNewMessage(listenerMap map[chan interface{}]*session.SessionInfo, use
 	event.Ts = sourceEvent.Ts
 	event.Text = sourceEvent.Text
 
-	if userListeners[sourceEvent.UserFrom] != nil {
-		for listener := range userListeners[sourceEvent.UserFrom] {
-			fromEv := new(EventNewMessage)
-			*fromEv = *event
-			fromEv.UserFrom = fmt.Sprint(sourceEvent.UserTo)
-			fromEv.IsOut = protocol.MSG_TYPE_OUT
-			select {
-			case listener <- fromEv:
-			default:
-			}
-
-		}
-	}
-
-	if userListeners[sourceEvent.UserTo] != nil {
-		for listener := range userListeners[sourceEvent.UserTo] {
-			toEv := new(EventNewMessage)
-			*toEv = *event
-			toEv.UserFrom = fmt.Sprint(sourceEvent.UserFrom)
-			toEv.UserFromName = sourceEvent.UserFromName
-			toEv.IsOut = protocol.MSG_TYPE_IN
-			select {
-			case listener <- toEv:
-			default:
-			}
-		}
-	}
+	fromEv := new(EventNewMessage)
+	*fromEv = *event
+	fromEv.UserFrom = fmt.Sprint(sourceEvent.UserTo)
+	fromEv.IsOut = protocol.MSG_TYPE_OUT
+	publishUserEvent(userListeners, sourceEvent.UserFrom, fromEv)
+
+	toEv := new(EventNewMessage)
+	*toEv = *event
+	toEv.UserFrom = fmt.Sprint(sourceEvent.UserFrom)
+	toEv.UserFromName = sourceEvent.UserFromName
+	toEv.IsOut = protocol.MSG_TYPE_IN
+	publishUserEvent(userListeners, sourceEvent.UserTo, toEv)
 }
 
 func handleNewTimelineEvent(listenerMap map[chan interface{}]*session.SessionInfo, userListeners map[uint64]map[chan interface{}]bool, ev *ControlEvent) {
@@ -196,32 +372,81 @@ func handleNewTimelineEvent(listenerMap map[chan interface{}]*session.SessionInf
 	}
 
 	for _, friendUserId := range evInfo.FriendUserIds {
-		listeners := userListeners[friendUserId]
-		if listeners == nil {
+		userEv := new(EventNewTimelineStatus)
+		userEv.Type = "EVENT_NEW_TIMELINE_EVENT"
+		userEv.Ts = evInfo.Ts
+		userEv.UserId = fmt.Sprint(evInfo.UserId)
+		userEv.Text = evInfo.Text
+		userEv.UserName = evInfo.UserName
+
+		publishUserEvent(userListeners, friendUserId, userEv)
+	}
+}
+
+func handleSessionRevoked(listenerMap map[chan interface{}]*session.SessionInfo, userListeners map[uint64]map[chan interface{}]bool, ev *ControlEvent) {
+	evInfo, ok := ev.Info.(*InternalEventSessionRevoked)
+	if !ok {
+		log.Println("Type assertion failed: evInfo is not InternalEventSessionRevoked in handleSessionRevoked")
+		return
+	}
+
+	for listener := range userListeners[evInfo.UserId] {
+		info := listenerMap[listener]
+		if evInfo.SessionId != "" && info.SessionId != evInfo.SessionId {
+			continue
+		} else if evInfo.TokenId != 0 && info.TokenId != evInfo.TokenId {
+			continue
+		} else if evInfo.ExceptSessionId != "" && (info.TokenId != 0 || info.SessionId == evInfo.ExceptSessionId) {
 			continue
 		}
 
-		for listener := range listeners {
-			userEv := new(EventNewTimelineStatus)
-			userEv.Type = "EVENT_NEW_TIMELINE_EVENT"
-			userEv.Ts = evInfo.Ts
-			userEv.UserId = fmt.Sprint(evInfo.UserId)
-			userEv.Text = evInfo.Text
-			userEv.UserName = evInfo.UserName
-
-			select {
-			case listener <- userEv:
-			default:
-			}
+		event := new(EventSessionRevoked)
+		event.Type = "EVENT_SESSION_REVOKED"
+		disconnectListener(listener, event)
+	}
+}
+
+// Send the last event to the listener and make it close the connection. Pending events
+// are discarded so that there is enough room in the channel for both values.
+func disconnectListener(listener chan interface{}, lastEvent interface{}) {
+drain:
+	for {
+		select {
+		case <-listener:
+		default:
+			break drain
 		}
 	}
+
+	select {
+	case listener <- lastEvent:
+	default:
+	}
+
+	select {
+	case listener <- nil:
+	default:
+		log.Println("Could not disconnect listener: channel is full")
+	}
 }
 
 func EventsDispatcher() {
 	listenerMap := make(map[chan interface{}]*session.SessionInfo)
 	userListeners := make(map[uint64]map[chan interface{}]bool)
 
-	for ev := range EventsFlow {
+	ticker := time.NewTicker(slowListenerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		var ev *ControlEvent
+
+		select {
+		case ev = <-EventsFlow:
+		case now := <-ticker.C:
+			checkSlowListeners(now)
+			continue
+		}
+
 		if ev.EvType == EVENT_USER_CONNECTED {
 			handleUserConnected(listenerMap, userListeners, ev)
 		} else if ev.EvType == EVENT_USER_DISCONNECTED {
@@ -235,18 +460,12 @@ func EventsDispatcher() {
 				continue
 			}
 
-			select {
-			case ev.Listener <- ev.Reply:
-			default:
-			}
+			sendReply(ev.Listener, ev.Reply)
+		} else if ev.EvType == EVENT_SESSION_REVOKED {
+			handleSessionRevoked(listenerMap, userListeners, ev)
 		} else if ev.EvType == EVENT_FRIEND_REQUEST {
 			reply := ev.Reply.(*EventFriendRequest)
-			for listener := range userListeners[reply.UserId] {
-				select {
-				case listener <- reply:
-				default:
-				}
-			}
+			publishUserEvent(userListeners, reply.UserId, reply)
 		}
 	}
 }
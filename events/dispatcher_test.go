@@ -0,0 +1,147 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendEventSlowListener(t *testing.T) {
+	listener := make(chan interface{}, 2)
+
+	for i := 0; i < 3; i++ {
+		sendEvent(listener, i)
+	}
+
+	if _, slow := slowListeners[listener]; !slow || len(listener) != 2 {
+		t.Fatalf("Listener with full channel must be marked as slow")
+	}
+
+	<-listener
+	sendEvent(listener, 3)
+	if len(listener) != 1 {
+		t.Fatalf("Event must be dropped until there is room for resync too")
+	}
+
+	<-listener
+	sendEvent(listener, 4)
+
+	if _, ok := (<-listener).(*EventResync); !ok {
+		t.Fatalf("Listener must get EVENT_RESYNC after it catches up")
+	}
+
+	if ev := <-listener; ev != 4 {
+		t.Fatalf("Unexpected event after resync: %v", ev)
+	}
+
+	if _, slow := slowListeners[listener]; slow {
+		t.Fatalf("Listener must not be slow after resync")
+	}
+}
+
+func TestSendEventDisconnect(t *testing.T) {
+	listener := make(chan interface{}, 2)
+	listener <- 0
+	listener <- 1
+
+	slowListeners[listener] = time.Now().Add(-2 * slowListenerTimeout)
+	sendEvent(listener, 2)
+
+	if _, ok := (<-listener).(*EventResync); !ok {
+		t.Fatalf("Disconnected listener must get EVENT_RESYNC")
+	}
+
+	if ev := <-listener; ev != nil {
+		t.Fatalf("Listener must be disconnected, got %v", ev)
+	}
+}
+
+func TestCheckSlowListeners(t *testing.T) {
+	caughtUp := make(chan interface{}, 2)
+	stuck := make(chan interface{}, 2)
+
+	for _, listener := range []chan interface{}{caughtUp, stuck} {
+		for i := 0; i < 3; i++ {
+			sendEvent(listener, i)
+		}
+	}
+
+	<-caughtUp
+	<-caughtUp
+
+	slowListeners[stuck] = time.Now().Add(-2 * slowListenerTimeout)
+	checkSlowListeners(time.Now())
+
+	if _, ok := (<-caughtUp).(*EventResync); !ok {
+		t.Fatalf("Listener that caught up must get EVENT_RESYNC without new events")
+	}
+
+	if _, ok := (<-stuck).(*EventResync); !ok {
+		t.Fatalf("Listener that is stuck must get EVENT_RESYNC before disconnect")
+	}
+
+	if ev := <-stuck; ev != nil {
+		t.Fatalf("Listener that is stuck must be disconnected without new events, got %v", ev)
+	}
+
+	if len(slowListeners) != 0 {
+		t.Fatalf("No listeners must be slow after the check: %v", slowListeners)
+	}
+}
+
+func TestSendReplySlowListener(t *testing.T) {
+	listener := make(chan interface{}, 2)
+	listener <- 0
+	listener <- 1
+
+	sendReply(listener, "reply1")
+	sendReply(listener, "reply2")
+
+	if len(pendingReplies[listener]) != 2 {
+		t.Fatalf("Replies that do not fit must be kept: %v", pendingReplies[listener])
+	}
+
+	<-listener
+	<-listener
+	checkSlowListeners(time.Now())
+
+	for _, expected := range []string{"reply1", "reply2"} {
+		if ev := <-listener; ev != expected {
+			t.Fatalf("Unexpected reply: got %v, expected %s", ev, expected)
+		}
+	}
+
+	if len(pendingReplies) != 0 {
+		t.Fatalf("No replies must be pending after the listener caught up: %v", pendingReplies)
+	}
+
+	checkSlowListeners(time.Now())
+	if _, ok := (<-listener).(*EventResync); !ok {
+		t.Fatalf("Listener must get EVENT_RESYNC after pending replies")
+	}
+
+	if _, slow := slowListeners[listener]; slow {
+		t.Fatalf("Listener must not be slow after resync")
+	}
+}
+
+func TestSendReplyTooManyPending(t *testing.T) {
+	listener := make(chan interface{}, 2)
+	listener <- 0
+	listener <- 1
+
+	for i := 0; i <= maxPendingReplies; i++ {
+		sendReply(listener, i)
+	}
+
+	if _, ok := (<-listener).(*EventResync); !ok {
+		t.Fatalf("Disconnected listener must get EVENT_RESYNC")
+	}
+
+	if ev := <-listener; ev != nil {
+		t.Fatalf("Listener with too many pending replies must be disconnected, got %v", ev)
+	}
+
+	if len(pendingReplies) != 0 || len(slowListeners) != 0 {
+		t.Fatalf("Disconnected listener must be forgotten: %v, %v", pendingReplies, slowListeners)
+	}
+}
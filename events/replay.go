@@ -0,0 +1,111 @@
+package events
+
+import "time"
+
+const (
+	// Client that has missed more events than this after reconnect gets EVENT_RESYNC.
+	// It must be well below listener channel capacity, so that replay fits into it.
+	replayBufferSize = 50
+
+	// Events of users that have no listeners are kept for this long after they disconnect
+	replayTTL = 10 * time.Minute
+
+	replaySweepInterval = time.Minute
+)
+
+type (
+	// Events that can be replayed have EventId set
+	replayableEvent interface {
+		setEventId(id uint64)
+	}
+
+	numberedEvent struct {
+		id uint64
+		ev interface{}
+	}
+
+	userStream struct {
+		lastId uint64
+		// The last replayBufferSize events, oldest first
+		buffer []numberedEvent
+		// Zero while user has listeners
+		disconnectedTs time.Time
+	}
+)
+
+var (
+	// Only used from EventsDispatcher goroutine
+	userStreams     = make(map[uint64]*userStream)
+	lastReplaySweep = time.Now()
+)
+
+func (e *BaseEvent) setEventId(id uint64) {
+	e.EventId = id
+}
+
+// Ids start from the current time in microseconds, so they keep growing when the stream
+// is forgotten and created again or when the server is restarted
+func newUserStream() *userStream {
+	return &userStream{lastId: uint64(time.Now().UnixNano() / int64(time.Microsecond))}
+}
+
+func (s *userStream) add(ev replayableEvent) {
+	s.lastId++
+	ev.setEventId(s.lastId)
+
+	if len(s.buffer) >= replayBufferSize {
+		copy(s.buffer, s.buffer[1:])
+		s.buffer = s.buffer[:len(s.buffer)-1]
+	}
+
+	s.buffer = append(s.buffer, numberedEvent{id: s.lastId, ev: ev})
+}
+
+// since returns events after lastEventId, ok is false when some of them are no longer in the buffer
+func (s *userStream) since(lastEventId uint64) (events []interface{}, ok bool) {
+	if lastEventId > s.lastId {
+		return nil, false
+	}
+
+	if lastEventId == s.lastId {
+		return nil, true
+	}
+
+	if len(s.buffer) == 0 || s.buffer[0].id > lastEventId+1 {
+		return nil, false
+	}
+
+	for _, e := range s.buffer {
+		if e.id > lastEventId {
+			events = append(events, e.ev)
+		}
+	}
+
+	return events, true
+}
+
+// publishUserEvent numbers the event and sends it to all listeners of the user. It is only
+// remembered for users that are connected or were connected recently.
+func publishUserEvent(userListeners map[uint64]map[chan interface{}]bool, userId uint64, ev replayableEvent) {
+	if s, ok := userStreams[userId]; ok {
+		s.add(ev)
+	}
+
+	for listener := range userListeners[userId] {
+		sendEvent(listener, ev)
+	}
+}
+
+func sweepUserStreams(now time.Time) {
+	if now.Sub(lastReplaySweep) < replaySweepInterval {
+		return
+	}
+
+	lastReplaySweep = now
+
+	for userId, s := range userStreams {
+		if !s.disconnectedTs.IsZero() && now.Sub(s.disconnectedTs) > replayTTL {
+			delete(userStreams, userId)
+		}
+	}
+}
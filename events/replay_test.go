@@ -0,0 +1,64 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserStreamSince(t *testing.T) {
+	s := newUserStream()
+	start := s.lastId
+
+	for i := 0; i < replayBufferSize+10; i++ {
+		ev := new(EventNewTimelineStatus)
+		s.add(ev)
+
+		if ev.EventId != start+uint64(i)+1 {
+			t.Fatalf("Unexpected event id %d for event %d", ev.EventId, i)
+		}
+	}
+
+	if evs, ok := s.since(s.lastId); !ok || len(evs) != 0 {
+		t.Fatalf("Client that has seen everything must get nothing, got %v, %v", evs, ok)
+	}
+
+	evs, ok := s.since(s.lastId - 3)
+	if !ok || len(evs) != 3 {
+		t.Fatalf("Expected 3 missed events, got %v, %v", evs, ok)
+	}
+
+	if id := evs[0].(*EventNewTimelineStatus).EventId; id != s.lastId-2 {
+		t.Fatalf("Unexpected first replayed event id: %d", id)
+	}
+
+	if evs, ok := s.since(s.lastId - replayBufferSize); !ok || len(evs) != replayBufferSize {
+		t.Fatalf("Whole buffer must be replayed, got %d events, %v", len(evs), ok)
+	}
+
+	if _, ok := s.since(s.lastId - replayBufferSize - 1); ok {
+		t.Fatalf("Gap bigger than the buffer must require resync")
+	}
+
+	if _, ok := s.since(s.lastId + 1); ok {
+		t.Fatalf("Id from the future must require resync")
+	}
+}
+
+func TestSweepUserStreams(t *testing.T) {
+	now := time.Now()
+
+	online := newUserStream()
+	gone := newUserStream()
+	gone.disconnectedTs = now.Add(-replayTTL - time.Second)
+	recent := newUserStream()
+	recent.disconnectedTs = now
+
+	userStreams = map[uint64]*userStream{1: online, 2: gone, 3: recent}
+	lastReplaySweep = now.Add(-replaySweepInterval - time.Second)
+
+	sweepUserStreams(now)
+
+	if _, ok := userStreams[2]; ok || len(userStreams) != 2 {
+		t.Fatalf("Only streams of users that left long ago must be removed: %v", userStreams)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/handlers"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+type exportFriends struct {
+	Friends        []protocol.JSUserInfo
+	FriendRequests []protocol.JSUserInfo
+}
+
+// ExportHandler streams zip archive with personal data of the logged in user.
+// Link is obtained through REQUEST_EXPORT_DATA and only works for the same user until it expires.
+func ExportHandler(w http.ResponseWriter, req *http.Request) {
+	info := getAuthUserInfo(req.Cookies())
+	if info == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You must be logged in to download your data"))
+		return
+	}
+
+	userId, ok := handlers.CheckExportToken(req.URL.Query().Get("token"))
+	if !ok || userId != info.Id {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Download link is invalid or expired, please request a new one"))
+		return
+	}
+
+	w.Header().Add("Content-type", "application/zip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="social-net-%d-%s.zip"`, userId, time.Now().Format("20060102")))
+
+	// Headers are already sent by the time something fails, so all we can do is to break the archive
+	zw := zip.NewWriter(w)
+	if err := writeExport(req.Context(), zw, userId); err != nil {
+		log.Printf("Could not export data of user %d: %s", userId, err.Error())
+		return
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Printf("Could not export data of user %d: %s", userId, err.Error())
+	}
+}
+
+func writeExport(ctx context.Context, zw *zip.Writer, userId uint64) error {
+	profile, err := db.GetExportProfile(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if err = writeJSONFile(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	friends, err := getExportFriends(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if err = writeJSONFile(zw, "friends.json", friends); err != nil {
+		return err
+	}
+
+	if err = writeExportMessages(ctx, zw, userId); err != nil {
+		return err
+	}
+
+	if err = writeExportPosts(ctx, zw, userId); err != nil {
+		return err
+	}
+
+	return writeExportAvatar(zw, userId)
+}
+
+func writeJSONFile(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func getExportFriends(ctx context.Context, userId uint64) (*exportFriends, error) {
+	friendIds, err := db.GetUserFriends(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	requestIds, err := db.GetUserFriendsRequests(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	userIds := make([]string, 0, len(friendIds)+len(requestIds))
+	for _, id := range append(friendIds, requestIds...) {
+		userIds = append(userIds, fmt.Sprint(id))
+	}
+
+	userNames, err := db.GetUserNames(ctx, userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &exportFriends{
+		Friends:        make([]protocol.JSUserInfo, 0, len(friendIds)),
+		FriendRequests: make([]protocol.JSUserInfo, 0, len(requestIds)),
+	}
+
+	for _, id := range userIds[:len(friendIds)] {
+		res.Friends = append(res.Friends, protocol.JSUserInfo{Id: id, Name: userNames[id]})
+	}
+
+	for _, id := range userIds[len(friendIds):] {
+		res.FriendRequests = append(res.FriendRequests, protocol.JSUserInfo{Id: id, Name: userNames[id]})
+	}
+
+	return res, nil
+}
+
+// jsonArrayWriter writes JSON array element by element into the current archive file
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (a *jsonArrayWriter) write(v interface{}) error {
+	sep := ",\n"
+	if a.count == 0 {
+		sep = "[\n"
+	}
+	a.count++
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+
+	_, err = a.w.Write(buf)
+	return err
+}
+
+func (a *jsonArrayWriter) close() error {
+	if a.count == 0 {
+		_, err := io.WriteString(a.w, "[]\n")
+		return err
+	}
+
+	_, err := io.WriteString(a.w, "\n]\n")
+	return err
+}
+
+// Every conversation goes into its own messages/<user id>.json file
+func writeExportMessages(ctx context.Context, zw *zip.Writer, userId uint64) error {
+	var (
+		cur   *jsonArrayWriter
+		curTo uint64
+	)
+
+	err := db.ExportMessages(ctx, userId, func(userTo uint64, msg *db.ExportMessage) error {
+		if cur == nil || userTo != curTo {
+			if cur != nil {
+				if err := cur.close(); err != nil {
+					return err
+				}
+			}
+
+			f, err := zw.Create(fmt.Sprintf("messages/%d.json", userTo))
+			if err != nil {
+				return err
+			}
+
+			cur, curTo = &jsonArrayWriter{w: f}, userTo
+		}
+
+		return cur.write(msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	if cur != nil {
+		return cur.close()
+	}
+
+	return nil
+}
+
+func writeExportPosts(ctx context.Context, zw *zip.Writer, userId uint64) error {
+	f, err := zw.Create("timeline.json")
+	if err != nil {
+		return err
+	}
+
+	arr := &jsonArrayWriter{w: f}
+	err = db.ExportPosts(ctx, userId, func(post *db.ExportPost) error {
+		return arr.write(post)
+	})
+	if err != nil {
+		return err
+	}
+
+	return arr.close()
+}
+
+func writeExportAvatar(zw *zip.Writer, userId uint64) error {
+	fp, err := os.Open(filepath.Join(config.Conf.AvatarDir, avatarPath(int(userId))))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	f, err := zw.Create("avatar.jpg")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, fp)
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONArrayWriter(t *testing.T) {
+	for _, items := range [][]int{nil, {1}, {1, 2, 3}} {
+		var buf bytes.Buffer
+		arr := &jsonArrayWriter{w: &buf}
+
+		for _, v := range items {
+			if err := arr.write(v); err != nil {
+				t.Fatalf("Could not write %d: %s", v, err.Error())
+			}
+		}
+
+		if err := arr.close(); err != nil {
+			t.Fatalf("Could not close array: %s", err.Error())
+		}
+
+		var res []int
+		if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+			t.Fatalf("Invalid JSON %q: %s", buf.String(), err.Error())
+		}
+
+		if len(res) != len(items) {
+			t.Fatalf("Unexpected result for %v: %v", items, res)
+		}
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"log"
 	"time"
 
+	"github.com/YuriyNasretdinov/social-net/handlers"
 	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/session"
 	"golang.org/x/net/websocket"
 )
 
@@ -35,7 +37,7 @@ func haveFlag(fl chan bool) bool {
 func setupAndGetConnection(addr string) (*websocket.Conn, error) {
 	time.Sleep(time.Millisecond * 100)
 
-	conf, err := websocket.NewConfig("ws://"+addr+"/events", "/")
+	conf, err := websocket.NewConfig("ws://"+addr+"/events", "http://"+addr)
 	if err != nil {
 		return nil, err
 	}
@@ -50,12 +52,12 @@ func setupAndGetConnection(addr string) (*websocket.Conn, error) {
 		return nil, errors.New("User already exists")
 	}
 
-	sessionId, err := loginUser(email, TEST_PASSWORD)
+	sessionId, _, err := loginUser(email, TEST_PASSWORD, "127.0.0.1", "functest")
 	if err != nil {
 		return nil, err
 	}
 
-	conf.Header.Add("Cookie", "id="+sessionId)
+	conf.Header.Add("Cookie", "id="+session.Sign(sessionId))
 
 	return websocket.DialConfig(conf)
 }
@@ -84,6 +86,8 @@ func responseReaderThread(c *websocket.Conn, online, connected, newmsg chan bool
 					log.Fatalf("Improper event new message, expected UserFrom=%d: %+v", TEST_USER_ID, value)
 				}
 				setFlag(newmsg)
+			case "EVENT_PING":
+				websocket.Message.Send(c, "REQUEST_PONG 0\n{}")
 			default:
 				respChan <- value
 			}
@@ -174,7 +178,7 @@ func checkFlag(fl chan bool, name string) {
 
 func testConvertUnderscoreToCamelCase() {
 	exp := "RequestGetMessages"
-	res := convertUnderscoreToCamelCase("REQUEST_GET_MESSAGES")
+	res := handlers.ConvertUnderscoreToCamelCase("REQUEST_GET_MESSAGES")
 	if res != exp {
 		log.Panicf("Unexpected result from convertUnderscoreToCamelCase, expected '%s', got '%s'", exp, res)
 	}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/mailer"
+	"github.com/YuriyNasretdinov/social-net/password"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/session"
+	"github.com/YuriyNasretdinov/social-net/validate"
+)
+
+const defaultDeletionGracePeriod = 7 * 24 * time.Hour
+
+func deletionGracePeriod() time.Duration {
+	if config.Conf.AccountDeletionGraceHours == 0 {
+		return defaultDeletionGracePeriod
+	}
+
+	return time.Duration(config.Conf.AccountDeletionGraceHours) * time.Hour
+}
+
+// checkPassword is used to re-confirm dangerous actions by the logged in user
+func checkPassword(ctx context.Context, userId uint64, userPassword string) (bool, error) {
+	var hash string
+	if err := db.GetPasswordStmt.QueryRowContext(ctx, userId).Scan(&hash); err != nil {
+		return false, err
+	}
+
+	ok, _ := password.Verify(userPassword, hash)
+	return ok, nil
+}
+
+func (ctx *WebsocketCtx) ProcessDeleteAccount(req *protocol.RequestDeleteAccount) (*protocol.ReplyDeleteAccount, *protocol.ResponseError) {
+	ok, err := checkPassword(ctx.Context, ctx.UserId, req.Password)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not delete account", Err: err}
+	} else if !ok {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Incorrect password"}
+	}
+
+	deleteAfter := time.Now().Add(deletionGracePeriod()).UnixNano()
+
+	if _, err = db.ScheduleDeletionStmt.ExecContext(ctx.Context, deleteAfter, ctx.UserId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not delete account", Err: err}
+	}
+
+	if err = AddSecurityEvent(ctx.Context, ctx.UserId, protocol.SECURITY_EVENT_DELETION_REQUESTED, ctx.IP); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not delete account", Err: err}
+	}
+
+	reply := new(protocol.ReplyDeleteAccount)
+	reply.DeleteAfterTs = fmt.Sprint(deleteAfter)
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessCancelDeleteAccount(req *protocol.RequestCancelDeleteAccount) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	if _, err := db.ScheduleDeletionStmt.ExecContext(ctx.Context, 0, ctx.UserId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not cancel account deletion", Err: err}
+	}
+
+	if err := AddSecurityEvent(ctx.Context, ctx.UserId, protocol.SECURITY_EVENT_DELETION_CANCELLED, ctx.IP); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not cancel account deletion", Err: err}
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessChangePassword(req *protocol.RequestChangePassword) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	ok, err := checkPassword(ctx.Context, ctx.UserId, req.OldPassword)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change password", Err: err}
+	} else if !ok {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Incorrect password"}
+	}
+
+	var email string
+	if err = db.GetEmailStmt.QueryRowContext(ctx.Context, ctx.UserId).Scan(&email); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change password", Err: err}
+	}
+
+	if err = validate.Password(req.NewPassword, ctx.UserName, email); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: err.Error(), Details: map[string]string{"NewPassword": err.Error()}}
+	}
+
+	hash, err := password.Hash(req.NewPassword)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change password", Err: err}
+	}
+
+	if _, err = db.UpdatePasswordStmt.ExecContext(ctx.Context, hash, ctx.UserId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change password", Err: err}
+	}
+
+	// Whoever knew the old password must not stay logged in
+	if err = session.DeleteUserSessions(ctx.UserId, ctx.SessionId); err != nil {
+		log.Printf("Could not delete sessions of user %d: %s", ctx.UserId, err.Error())
+	}
+
+	events.EventsFlow <- &events.ControlEvent{
+		EvType: events.EVENT_SESSION_REVOKED,
+		Info: &events.InternalEventSessionRevoked{
+			UserId:          ctx.UserId,
+			ExceptSessionId: ctx.SessionId,
+		},
+	}
+
+	if err = AddSecurityEvent(ctx.Context, ctx.UserId, protocol.SECURITY_EVENT_PASSWORD_CHANGED, ctx.IP); err != nil {
+		log.Println("Could not add security event: ", err.Error())
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
+}
+
+// Email is only changed when user follows the link sent to the new address,
+// the old address gets a notification so that the owner can react if it was not them
+func (ctx *WebsocketCtx) ProcessChangeEmail(req *protocol.RequestChangeEmail) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	ok, err := checkPassword(ctx.Context, ctx.UserId, req.Password)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change email", Err: err}
+	} else if !ok {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Incorrect password"}
+	}
+
+	newEmail, err := validate.Email(req.NewEmail)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: err.Error(), Details: map[string]string{"NewEmail": err.Error()}}
+	}
+
+	var oldEmail, hash string
+	if err = db.GetCredentialsStmt.QueryRowContext(ctx.Context, ctx.UserId).Scan(&oldEmail, &hash); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change email", Err: err}
+	}
+
+	if strings.EqualFold(oldEmail, newEmail) {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "This is your current email"}
+	}
+
+	if _, err = db.GetLoginInfo(ctx.Context, newEmail); err == nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_ALREADY_EXISTS, UserMsg: "This email is already used by another account"}
+	} else if err != sql.ErrNoRows {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not change email", Err: err}
+	}
+
+	err = SendVerificationEmail(VERIFICATION_CHANGE_EMAIL, ctx.SiteURL, ctx.UserId, ctx.UserName, newEmail, accountStamp(oldEmail, hash))
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not send confirmation to the new email", Err: err}
+	}
+
+	err = mailer.Send(oldEmail, "Email change requested", fmt.Sprintf(
+		"Hello, %s!\n\nSomeone asked to change email of your account to %s from %s.\n"+
+			"If it was not you, change your password right away: that also cancels the email change.",
+		ctx.UserName, newEmail, ctx.IP,
+	))
+	if err != nil {
+		log.Printf("Could not notify user %d about email change: %s", ctx.UserId, err.Error())
+	}
+
+	if err = AddSecurityEvent(ctx.Context, ctx.UserId, protocol.SECURITY_EVENT_EMAIL_CHANGE_REQUESTED, ctx.IP); err != nil {
+		log.Println("Could not add security event: ", err.Error())
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
+}
+
+// ConfirmEmailChange makes email from VERIFICATION_CHANGE_EMAIL link the new email of the user.
+// ok is false when email or password has changed since the link was sent.
+func ConfirmEmailChange(ctx context.Context, userId uint64, stamp, newEmail string) (ok bool, err error) {
+	var oldEmail, hash string
+	if err = db.GetCredentialsStmt.QueryRowContext(ctx, userId).Scan(&oldEmail, &hash); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if accountStamp(oldEmail, hash) != stamp {
+		return false, nil
+	}
+
+	// Email and password are checked again in case they change concurrently
+	res, err := db.ChangeEmailStmt.ExecContext(ctx, newEmail, userId, oldEmail, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
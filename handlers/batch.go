@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+// Requests that change the connection itself cannot be part of a batch
+var notBatchableRequests = map[string]bool{
+	"REQUEST_BATCH": true,
+	"REQUEST_HELLO": true,
+}
+
+// ProcessBatch dispatches every item the same way as a separate frame would be,
+// so a failed item only gets its own REPLY_ERROR and the rest are still processed
+func (ctx *WebsocketCtx) ProcessBatch(req *protocol.RequestBatch) (*protocol.ReplyBatch, *protocol.ResponseError) {
+	if len(req.Requests) > protocol.MAX_BATCH_SIZE {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: fmt.Sprintf("Batch cannot contain more than %d requests", protocol.MAX_BATCH_SIZE)}
+	}
+
+	reply := new(protocol.ReplyBatch)
+	reply.Replies = make([]protocol.Reply, 0, len(req.Requests))
+
+	for _, item := range req.Requests {
+		reply.Replies = append(reply.Replies, ctx.processBatchItem(item))
+	}
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) processBatchItem(item protocol.BatchItem) protocol.Reply {
+	var err error
+
+	reqType, data := item.Type, item.Data
+	if ctx.Adapter != nil {
+		if reqType, data, err = ctx.Adapter.AdaptRequest(reqType, data); err != nil {
+			return protocol.NewReplyError(item.SeqId, protocol.ERROR_INVALID_ARGUMENT, err.Error())
+		}
+	}
+
+	if notBatchableRequests[reqType] {
+		return protocol.NewReplyError(item.SeqId, protocol.ERROR_INVALID_ARGUMENT, reqType+" cannot be a part of batch")
+	}
+
+	userReq, err := NewRequest(reqType)
+	if err != nil {
+		return protocol.NewReplyError(item.SeqId, protocol.ERROR_NOT_FOUND, "Invalid request type: "+reqType)
+	}
+
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, userReq.Data); err != nil {
+			return protocol.NewReplyError(item.SeqId, protocol.ERROR_INVALID_ARGUMENT, "Cannot decode request: "+err.Error())
+		}
+	}
+
+	itemCtx := *ctx
+	itemCtx.SeqId = item.SeqId
+
+	resp := itemCtx.Dispatch(userReq)
+	if v, ok := resp.(*protocol.ResponseError); ok {
+		return v.ToReply(item.SeqId)
+	}
+
+	resp.SetSeqId(item.SeqId)
+
+	if ctx.Adapter != nil {
+		if adapted, ok := ctx.Adapter.AdaptReply(resp).(protocol.Reply); ok {
+			return adapted
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+func TestProcessBatch(t *testing.T) {
+	defer func(saved []Interceptor) { interceptors = saved }(interceptors)
+	interceptors = []Interceptor{ScopeInterceptor}
+
+	ctx := &WebsocketCtx{TokenId: 1, Scopes: []string{protocol.SCOPE_READ}}
+
+	req := &protocol.RequestBatch{Requests: []protocol.BatchItem{
+		{Type: "REQUEST_DESCRIBE", SeqId: 1},
+		{Type: "REQUEST_NO_SUCH_THING", SeqId: 2},
+		{Type: "REQUEST_HELLO", SeqId: 3, Data: json.RawMessage(`{"Version": 1}`)},
+		{Type: "REQUEST_SEND_MESSAGE", SeqId: 4, Data: json.RawMessage(`{}`)},
+		{Type: "REQUEST_GET_MESSAGES", SeqId: 5, Data: json.RawMessage(`{"Limit": "abc"}`)},
+	}}
+
+	reply, errResp := ctx.ProcessBatch(req)
+	if errResp != nil || len(reply.Replies) != len(req.Requests) {
+		t.Fatalf("Unexpected batch reply: %+v", reply)
+	}
+
+	if describe, ok := reply.Replies[0].(*protocol.ReplyDescribe); !ok || describe.SeqId != 1 || describe.Type != "REPLY_DESCRIBE" {
+		t.Fatalf("Unexpected reply for REQUEST_DESCRIBE: %+v", reply.Replies[0])
+	}
+
+	codes := []string{
+		protocol.ERROR_NOT_FOUND,
+		protocol.ERROR_INVALID_ARGUMENT,
+		protocol.ERROR_PERMISSION_DENIED,
+		protocol.ERROR_INVALID_ARGUMENT,
+	}
+
+	for i, r := range reply.Replies[1:] {
+		errReply, ok := r.(*protocol.ReplyError)
+		if !ok || errReply.SeqId != i+2 || errReply.Code != codes[i] || errReply.Retryable {
+			t.Fatalf("Expected %s error for item %d, got %+v", codes[i], i+2, r)
+		}
+	}
+
+	tooBig := &protocol.RequestBatch{Requests: make([]protocol.BatchItem, protocol.MAX_BATCH_SIZE+1)}
+	if _, errResp := ctx.ProcessBatch(tooBig); errResp == nil {
+		t.Fatalf("Batch that is too big must be rejected")
+	}
+}
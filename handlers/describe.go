@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+type (
+	jsonSchema map[string]interface{}
+
+	requestDescription struct {
+		Request   jsonSchema `json:"request"`
+		Reply     jsonSchema `json:"reply"`
+		ReplyType string     `json:"replyType"`
+	}
+
+	protocolDescription struct {
+		Schema      string                        `json:"$schema"`
+		Title       string                        `json:"title"`
+		Requests    map[string]requestDescription `json:"requests"`
+		Error       jsonSchema                    `json:"error"`
+		Events      map[string]jsonSchema         `json:"events"`
+		Definitions map[string]jsonSchema         `json:"definitions"`
+	}
+)
+
+// Generated once on startup, so it always matches the code that is running
+var protocolSchema = mustDescribeProtocol()
+
+// ProtocolSchema returns JSON Schema of all requests, replies and events
+func ProtocolSchema() []byte {
+	return protocolSchema
+}
+
+func (ctx *WebsocketCtx) ProcessDescribe(req *protocol.RequestDescribe) (*protocol.ReplyDescribe, *protocol.ResponseError) {
+	reply := new(protocol.ReplyDescribe)
+	reply.Schema = protocolSchema
+
+	return reply, nil
+}
+
+func mustDescribeProtocol() []byte {
+	desc, err := describeProtocol()
+	if err != nil {
+		panic("Could not describe protocol: " + err.Error())
+	}
+
+	res, err := json.MarshalIndent(desc, "", "  ")
+	if err != nil {
+		panic("Could not encode protocol description: " + err.Error())
+	}
+
+	return res
+}
+
+func describeProtocol() (*protocolDescription, error) {
+	defs := make(map[string]jsonSchema)
+
+	desc := &protocolDescription{
+		Schema:      "http://json-schema.org/draft-07/schema#",
+		Title:       "social-net protocol: websocket frames are \"<request type> <seq id>[ ordered]\\n<request JSON>\", \"REQUEST_CANCEL <seq id>\\n{}\" cancels a request, \"REQUEST_PONG <seq id>\\n{}\" answers EVENT_PING, HTTP API is POST /api/v1/<request type>",
+		Requests:    make(map[string]requestDescription),
+		Error:       typeSchema(reflect.TypeOf(protocol.ReplyError{}), defs),
+		Events:      make(map[string]jsonSchema),
+		Definitions: defs,
+	}
+
+	for i := 0; i < ctxType.NumMethod(); i++ {
+		method := ctxType.Method(i)
+		if !strings.HasPrefix(method.Name, "Process") {
+			continue
+		}
+
+		reqType := "REQUEST_" + ConvertCamelCaseToUnderscore(strings.TrimPrefix(method.Name, "Process"))
+
+		if err := checkProcessMethod(method); err != nil {
+			return nil, err
+		}
+
+		replyType := method.Type.Out(0).Elem()
+
+		desc.Requests[reqType] = requestDescription{
+			Request:   typeSchema(method.Type.In(1).Elem(), defs),
+			Reply:     typeSchema(replyType, defs),
+			ReplyType: ConvertCamelCaseToUnderscore(replyType.Name()),
+		}
+	}
+
+	for evType, ev := range events.ClientEvents {
+		desc.Events[evType] = typeSchema(reflect.TypeOf(ev), defs)
+	}
+
+	return desc, nil
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// typeSchema describes t the way encoding/json encodes it. Named structs are put into defs
+// and referenced, so shared types like protocol.Message are described once.
+func typeSchema(t reflect.Type, defs map[string]jsonSchema) jsonSchema {
+	if t == rawMessageType {
+		return jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, defs)
+		}
+
+		if _, ok := defs[t.Name()]; !ok {
+			// placeholder protects from infinite recursion on self-referencing types
+			defs[t.Name()] = jsonSchema{}
+			defs[t.Name()] = structSchema(t, defs)
+		}
+
+		return jsonSchema{"$ref": "#/definitions/" + t.Name()}
+	}
+
+	return jsonSchema{}
+}
+
+func structSchema(t reflect.Type, defs map[string]jsonSchema) jsonSchema {
+	props := make(map[string]jsonSchema)
+	addStructFields(t, props, defs)
+
+	return jsonSchema{"type": "object", "properties": props}
+}
+
+func addStructFields(t reflect.Type, props map[string]jsonSchema, defs map[string]jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if pos := strings.IndexByte(tag, ','); pos >= 0 {
+			name, opts = tag[:pos], tag[pos+1:]
+		}
+
+		// fields of embedded structs are encoded as if they were declared in the outer struct
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(f.Type, props, defs)
+			continue
+		}
+
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Interface {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := typeSchema(f.Type, defs)
+
+		// `json:",string"` is used for ids that do not fit into JavaScript numbers
+		for _, opt := range strings.Split(opts, ",") {
+			if opt == "string" && (schema["type"] == "integer" || schema["type"] == "number" || schema["type"] == "boolean") {
+				schema = jsonSchema{"type": "string", "description": fmt.Sprintf("%s encoded as string", schema["type"])}
+			}
+		}
+
+		props[name] = schema
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestProtocolSchema(t *testing.T) {
+	var desc struct {
+		Requests map[string]struct {
+			Request   map[string]interface{}
+			Reply     map[string]interface{}
+			ReplyType string
+		}
+		Events      map[string]interface{}
+		Definitions map[string]struct {
+			Properties map[string]map[string]interface{}
+		}
+	}
+
+	if err := json.Unmarshal(ProtocolSchema(), &desc); err != nil {
+		t.Fatalf("Could not decode schema: %s", err.Error())
+	}
+
+	getMessages, ok := desc.Requests["REQUEST_GET_MESSAGES"]
+	if !ok || getMessages.ReplyType != "REPLY_MESSAGES_LIST" {
+		t.Fatalf("Unexpected description of REQUEST_GET_MESSAGES: %+v", getMessages)
+	}
+
+	if _, ok := desc.Requests["REQUEST_DESCRIBE"]; !ok {
+		t.Fatalf("REQUEST_DESCRIBE is not described")
+	}
+
+	if _, ok := desc.Events["EVENT_NEW_MESSAGE"]; !ok {
+		t.Fatalf("EVENT_NEW_MESSAGE is not described")
+	}
+
+	// embedded BaseReply fields are flattened and string-encoded ids are strings
+	profile := desc.Definitions["ReplyGetProfile"].Properties
+	if profile["SeqId"]["type"] != "integer" || profile["CityId"]["type"] != "string" {
+		t.Fatalf("Unexpected ReplyGetProfile properties: %+v", profile)
+	}
+}
+
+func TestCheckProcessMethod(t *testing.T) {
+	method, _ := reflect.TypeOf((*WebsocketCtx)(nil)).MethodByName("ProcessGetMessages")
+	if err := checkProcessMethod(method); err != nil {
+		t.Fatalf("Unexpected error for ProcessGetMessages: %s", err.Error())
+	}
+
+	method, _ = reflect.TypeOf((*WebsocketCtx)(nil)).MethodByName("Dispatch")
+	if err := checkProcessMethod(method); err == nil {
+		t.Fatalf("Method that does not return a reply and an error must be rejected")
+	}
+}
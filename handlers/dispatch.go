@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+const defaultRequestTimeout = 30 * time.Second
+
+var (
+	ctxType           = reflect.TypeOf((*WebsocketCtx)(nil))
+	replyType         = reflect.TypeOf((*protocol.Reply)(nil)).Elem()
+	responseErrorType = reflect.TypeOf((*protocol.ResponseError)(nil))
+
+	ErrUnknownRequest = errors.New("Invalid request type")
+)
+
+// RequestTimeout is the deadline for the context of every request
+func RequestTimeout() time.Duration {
+	if config.Conf.RequestTimeoutSeconds == 0 {
+		return defaultRequestTimeout
+	}
+
+	return time.Duration(config.Conf.RequestTimeoutSeconds) * time.Second
+}
+
+// Request is a request of the given type that is ready to be decoded into Data.
+// It is shared by websocket and HTTP API so that both support the same set of requests.
+type Request struct {
+	Type string
+	Data interface{}
+
+	method reflect.Method
+}
+
+// REQUEST_GET_MESSAGES => RequestGetMessages
+func ConvertUnderscoreToCamelCase(in string) string {
+	parts := strings.Split(in, "_")
+	out := make([]string, 0, len(parts))
+	for _, v := range parts {
+		if v == "" {
+			continue
+		}
+		out = append(out, strings.ToUpper(v[0:1]), strings.ToLower(v[1:]))
+	}
+	return strings.Join(out, "")
+}
+
+// ReplyGetMessages => REPLY_GET_MESSAGES
+func ConvertCamelCaseToUnderscore(in string) string {
+	out := make([]rune, 0)
+
+	for _, c := range in {
+		if unicode.IsUpper(c) && len(out) > 0 {
+			out = append(out, '_')
+		}
+		out = append(out, unicode.ToUpper(c))
+	}
+
+	return string(out)
+}
+
+// Process methods look like ProcessXxx(req *protocol.RequestXxx) (*protocol.ReplyYyy, *protocol.ResponseError),
+// so that the concrete reply type is known from the signature. checkProcessMethod is called
+// for all of them on startup by describeProtocol.
+func checkProcessMethod(method reflect.Method) error {
+	t := method.Type
+	if t.NumIn() != 2 || t.In(1).Kind() != reflect.Ptr || t.NumOut() != 2 {
+		return fmt.Errorf("%s must accept a request pointer and return a reply and *protocol.ResponseError", method.Name)
+	}
+
+	if t.Out(0).Kind() != reflect.Ptr || !t.Out(0).Implements(replyType) || t.Out(1) != responseErrorType {
+		return fmt.Errorf("%s must return a pointer to reply struct and *protocol.ResponseError", method.Name)
+	}
+
+	return nil
+}
+
+// NewRequest finds ProcessXXX method for REQUEST_XXX and allocates request structure for it
+func NewRequest(reqType string) (*Request, error) {
+	method, ok := ctxType.MethodByName("Process" + ConvertUnderscoreToCamelCase(strings.TrimPrefix(reqType, "REQUEST_")))
+	if !ok {
+		return nil, ErrUnknownRequest
+	}
+
+	return &Request{
+		Type:   reqType,
+		Data:   reflect.New(method.Type.In(1).Elem()).Interface(),
+		method: method,
+	}, nil
+}
+
+// Dispatch calls the Process method for the request through the interceptors registered with Use.
+// Successful replies get their type, e.g. REPLY_GET_MESSAGES. Errors caused by cancelled
+// context tell the client why the request failed instead of showing the db error.
+func (ctx *WebsocketCtx) Dispatch(req *Request) protocol.Reply {
+	if ctx.Context == nil {
+		ctx.Context = context.Background()
+	}
+
+	process := func(ctx *WebsocketCtx, reqType string, data interface{}) protocol.Reply {
+		out := req.method.Func.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(data)})
+		if errResp := out[1].Interface().(*protocol.ResponseError); errResp != nil {
+			return errResp
+		}
+
+		return out[0].Interface().(protocol.Reply)
+	}
+
+	var resp protocol.Reply
+	if ctx.Context.Err() != nil {
+		// Cancelled or timed out while waiting in the queue, error code is set below
+		resp = &protocol.ResponseError{}
+	} else {
+		resp = chain(interceptors, process)(ctx, req.Type, req.Data)
+	}
+
+	errResp, ok := resp.(*protocol.ResponseError)
+	if !ok {
+		resp.SetReplyType(ConvertCamelCaseToUnderscore(reflect.TypeOf(resp).Elem().Name()))
+		return resp
+	}
+
+	switch ctx.Context.Err() {
+	case context.Canceled:
+		errResp.Code, errResp.UserMsg = protocol.ERROR_CANCELLED, "Request was cancelled"
+	case context.DeadlineExceeded:
+		errResp.Code, errResp.UserMsg = protocol.ERROR_DEADLINE_EXCEEDED, "Request timed out"
+	}
+
+	return resp
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+func TestNewRequest(t *testing.T) {
+	req, err := NewRequest("REQUEST_GET_MESSAGES")
+	if err != nil {
+		t.Fatalf("Could not create request: %s", err.Error())
+	}
+
+	if _, ok := req.Data.(*protocol.RequestGetMessages); !ok {
+		t.Fatalf("Unexpected request data type: %T", req.Data)
+	}
+
+	for _, reqType := range []string{"REQUEST_NO_SUCH_THING", "REQUEST_", "", "REQUEST_DISPATCH"} {
+		if _, err := NewRequest(reqType); err != ErrUnknownRequest {
+			t.Fatalf("Request type %q must be unknown, got %v", reqType, err)
+		}
+	}
+}
+
+func TestConvertCase(t *testing.T) {
+	if res := ConvertUnderscoreToCamelCase("REQUEST_GET_MESSAGES"); res != "RequestGetMessages" {
+		t.Fatalf("Unexpected result from ConvertUnderscoreToCamelCase: %q", res)
+	}
+
+	if res := ConvertCamelCaseToUnderscore("ReplyGetMessages"); res != "REPLY_GET_MESSAGES" {
+		t.Fatalf("Unexpected result from ConvertCamelCaseToUnderscore: %q", res)
+	}
+}
+
+func TestDispatchCancelled(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, err := NewRequest("REQUEST_BATCH")
+	if err != nil {
+		t.Fatalf("Could not create request: %s", err.Error())
+	}
+
+	// too big batch fails without touching the db
+	req.Data.(*protocol.RequestBatch).Requests = make([]protocol.BatchItem, protocol.MAX_BATCH_SIZE+1)
+
+	resp := (&WebsocketCtx{Context: reqCtx}).Dispatch(req)
+	if v, ok := resp.(*protocol.ResponseError); !ok || v.Code != protocol.ERROR_CANCELLED || v.UserMsg != "Request was cancelled" {
+		t.Fatalf("Unexpected reply for cancelled request: %+v", resp)
+	}
+}
+
+func TestDispatchCancelledBeforeStart(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, err := NewRequest("REQUEST_DESCRIBE")
+	if err != nil {
+		t.Fatalf("Could not create request: %s", err.Error())
+	}
+
+	resp := (&WebsocketCtx{Context: reqCtx}).Dispatch(req)
+	if v, ok := resp.(*protocol.ResponseError); !ok || v.Code != protocol.ERROR_CANCELLED {
+		t.Fatalf("Request cancelled in the queue must not be processed, got %+v", resp)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+const (
+	exportTokenPrefix = "export:"
+	exportLinkTTL     = time.Hour
+)
+
+// Export link contains signed user id and expiration time, so nothing needs to be stored
+// until the archive is actually downloaded
+func exportToken(userId uint64, expires time.Time) string {
+	return session.Sign(fmt.Sprintf("%s%d:%d", exportTokenPrefix, userId, expires.Unix()))
+}
+
+// CheckExportToken returns user id from the export link token if it is valid and not expired
+func CheckExportToken(token string) (userId uint64, ok bool) {
+	value, ok := session.Unsign(token)
+	if !ok || !strings.HasPrefix(value, exportTokenPrefix) {
+		return 0, false
+	}
+
+	parts := strings.Split(value[len(exportTokenPrefix):], ":")
+	if len(parts) != 2 {
+		return 0, false
+	}
+
+	userId, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+
+	return userId, true
+}
+
+func (ctx *WebsocketCtx) ProcessExportData(req *protocol.RequestExportData) (*protocol.ReplyExportData, *protocol.ResponseError) {
+	expires := time.Now().Add(exportLinkTTL)
+
+	reply := new(protocol.ReplyExportData)
+	reply.Url = "/export?token=" + url.QueryEscape(exportToken(ctx.UserId, expires))
+	reply.ExpiresTs = fmt.Sprint(expires.UnixNano())
+
+	return reply, nil
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -9,9 +10,12 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/YuriyNasretdinov/social-net/config"
 	"github.com/YuriyNasretdinov/social-net/db"
 	"github.com/YuriyNasretdinov/social-net/events"
 	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/ratelimit"
+	"github.com/YuriyNasretdinov/social-net/session"
 )
 
 const (
@@ -23,14 +27,44 @@ const (
 
 type (
 	WebsocketCtx struct {
-		SeqId    int
-		UserId   uint64
-		Listener chan interface{}
-		UserName string
+		SeqId     int
+		UserId    uint64
+		Listener  chan interface{}
+		UserName  string
+		SessionId string
+		IP        string
+
+		// Base for links in emails, e.g. "https://vbambuke.ru"
+		SiteURL string
+
+		// Set when user is authenticated with API token instead of session
+		TokenId uint64
+		Scopes  []string
+
+		// Adapter for the protocol version of the client, nil for the current one
+		Adapter ProtocolAdapter
+
+		EmailVerified bool
+
+		// Bucket of the websocket connection, nil for HTTP API
+		RateLimit *ratelimit.Bucket
+
+		// Cancelled when client goes away or cancels the request, has a deadline of RequestTimeout.
+		// All db calls made for the request must use it.
+		Context context.Context
 	}
 )
 
-func (ctx *WebsocketCtx) ProcessGetMessages(req *protocol.RequestGetMessages) protocol.Reply {
+// Returns error when unverified users are not allowed to perform actions that other users can see
+func (ctx *WebsocketCtx) checkEmailVerified() *protocol.ResponseError {
+	if ctx.EmailVerified || config.Conf.EmailVerification != config.EMAIL_VERIFICATION_RESTRICT {
+		return nil
+	}
+
+	return &protocol.ResponseError{Code: protocol.ERROR_FAILED_PRECONDITION, UserMsg: "You must confirm your email first"}
+}
+
+func (ctx *WebsocketCtx) ProcessGetMessages(req *protocol.RequestGetMessages) (*protocol.ReplyMessagesList, *protocol.ResponseError) {
 	dateEnd := req.DateEnd
 
 	if dateEnd == "" {
@@ -43,12 +77,12 @@ func (ctx *WebsocketCtx) ProcessGetMessages(req *protocol.RequestGetMessages) pr
 	}
 
 	if limit <= 0 {
-		return &protocol.ResponseError{UserMsg: "Limit must be greater than 0"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
 	}
 
-	rows, err := db.GetMessagesStmt.Query(ctx.UserId, req.UserTo, dateEnd, limit)
+	rows, err := db.GetMessagesStmt.QueryContext(ctx.Context, ctx.UserId, req.UserTo, dateEnd, limit)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Cannot select messages", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select messages", Err: err}
 	}
 
 	reply := new(protocol.ReplyMessagesList)
@@ -58,37 +92,37 @@ func (ctx *WebsocketCtx) ProcessGetMessages(req *protocol.RequestGetMessages) pr
 	for rows.Next() {
 		var msg protocol.Message
 		if err = rows.Scan(&msg.Id, &msg.Text, &msg.Ts, &msg.IsOut); err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select messages", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select messages", Err: err}
 		}
 		msg.UserFrom = fmt.Sprint(req.UserTo)
 		reply.Messages = append(reply.Messages, msg)
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList) (*protocol.ReplyUsersList, *protocol.ResponseError) {
 	limit := req.Limit
 	if limit > protocol.MAX_USERS_LIST_LIMIT {
 		limit = protocol.MAX_USERS_LIST_LIMIT
 	}
 
 	if limit <= 0 {
-		return &protocol.ResponseError{UserMsg: "Limit must be greater than 0"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
 	}
 
 	var rows *sql.Rows
 	var err error
 
 	if req.Search == "" {
-		rows, err = db.GetUsersListStmt.Query(req.MinId, limit)
+		rows, err = db.GetUsersListStmt.QueryContext(ctx.Context, req.MinId, limit)
 		if err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select users", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select users", Err: err}
 		}
 	} else {
-		rows, err = db.GetUsersListWithSearchStmt.Query(req.MinId, "%"+req.Search+"%", limit)
+		rows, err = db.GetUsersListWithSearchStmt.QueryContext(ctx.Context, req.MinId, "%"+req.Search+"%", limit)
 		if err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select users", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select users", Err: err}
 		}
 	}
 
@@ -103,7 +137,7 @@ func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList)
 		var potentialFriendId int64
 
 		if err = rows.Scan(&user.Name, &potentialFriendId); err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select users", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select users", Err: err}
 		}
 
 		user.Id = fmt.Sprint(potentialFriendId)
@@ -114,10 +148,10 @@ func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList)
 	friendsMap := make(map[string]bool)
 
 	if len(potentialFriends) > 0 {
-		friendRows, err := db.Db.Query(`SELECT friend_user_id, request_accepted FROM friend
-		WHERE user_id = ` + fmt.Sprint(ctx.UserId) + ` AND friend_user_id IN(` + strings.Join(potentialFriends, ",") + `)`)
+		friendRows, err := db.Db.QueryContext(ctx.Context, `SELECT friend_user_id, request_accepted FROM friend
+		WHERE user_id = `+fmt.Sprint(ctx.UserId)+` AND friend_user_id IN(`+strings.Join(potentialFriends, ",")+`)`)
 		if err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select users", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select users", Err: err}
 		}
 		defer friendRows.Close()
 
@@ -125,7 +159,7 @@ func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList)
 			var friendId string
 			var requestAccepted bool
 			if err = friendRows.Scan(&friendId, &requestAccepted); err != nil {
-				return &protocol.ResponseError{UserMsg: "Cannot select users", Err: err}
+				return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select users", Err: err}
 			}
 
 			friendsMap[friendId] = requestAccepted
@@ -136,27 +170,27 @@ func (ctx *WebsocketCtx) ProcessGetUsersList(req *protocol.RequestGetUsersList)
 		reply.Users[i].FriendshipConfirmed, reply.Users[i].IsFriend = friendsMap[user.Id]
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetFriends(req *protocol.RequestGetFriends) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetFriends(req *protocol.RequestGetFriends) (*protocol.ReplyGetFriends, *protocol.ResponseError) {
 	limit := req.Limit
 	if limit > protocol.MAX_FRIENDS_LIMIT {
 		limit = protocol.MAX_FRIENDS_LIMIT
 	}
 
 	if limit <= 0 {
-		return &protocol.ResponseError{UserMsg: "Limit must be greater than 0"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
 	}
 
-	friendUserIds, err := db.GetUserFriends(ctx.UserId)
+	friendUserIds, err := db.GetUserFriends(ctx.Context, ctx.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get friends", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get friends", Err: err}
 	}
 
-	friendRequestUserIds, err := db.GetUserFriendsRequests(ctx.UserId)
+	friendRequestUserIds, err := db.GetUserFriendsRequests(ctx.Context, ctx.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get friends", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get friends", Err: err}
 	}
 
 	reply := new(protocol.ReplyGetFriends)
@@ -177,9 +211,9 @@ func (ctx *WebsocketCtx) ProcessGetFriends(req *protocol.RequestGetFriends) prot
 		friendUserIdsStr = append(friendUserIdsStr, userIdStr)
 	}
 
-	userNames, err := db.GetUserNames(friendUserIdsStr)
+	userNames, err := db.GetUserNames(ctx.Context, friendUserIdsStr)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get friends", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get friends", Err: err}
 	}
 
 	for i, user := range reply.Users {
@@ -190,30 +224,34 @@ func (ctx *WebsocketCtx) ProcessGetFriends(req *protocol.RequestGetFriends) prot
 		reply.FriendRequests[i].Name = userNames[user.Id]
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessSendMessage(req *protocol.RequestSendMessage) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessSendMessage(req *protocol.RequestSendMessage) (*protocol.ReplyGeneric, *protocol.ResponseError) {
 	// TODO: verify that user has rights to send message to the specified person
 	var (
 		err error
 		now = time.Now().UnixNano()
 	)
 
+	if errReply := ctx.checkEmailVerified(); errReply != nil {
+		return nil, errReply
+	}
+
 	if len(req.Text) == 0 {
-		return &protocol.ResponseError{UserMsg: "Message text must not be empty"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Message text must not be empty"}
 	} else if utf8.RuneCountInString(req.Text) > maxMessageLength {
-		return &protocol.ResponseError{UserMsg: fmt.Sprintf("Text cannot exceed %d characters", maxMessageLength)}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: fmt.Sprintf("Text cannot exceed %d characters", maxMessageLength)}
 	}
 
-	_, err = db.SendMessageStmt.Exec(ctx.UserId, req.UserTo, protocol.MSG_TYPE_OUT, req.Text, now)
+	_, err = db.SendMessageStmt.ExecContext(ctx.Context, ctx.UserId, req.UserTo, protocol.MSG_TYPE_OUT, req.Text, now)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not log outgoing message", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not log outgoing message", Err: err}
 	}
 
-	_, err = db.SendMessageStmt.Exec(req.UserTo, ctx.UserId, protocol.MSG_TYPE_IN, req.Text, now)
+	_, err = db.SendMessageStmt.ExecContext(ctx.Context, req.UserTo, ctx.UserId, protocol.MSG_TYPE_IN, req.Text, now)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not log incoming message", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not log incoming message", Err: err}
 	}
 
 	reply := new(protocol.ReplyGeneric)
@@ -231,29 +269,33 @@ func (ctx *WebsocketCtx) ProcessSendMessage(req *protocol.RequestSendMessage) pr
 		},
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessAddFriend(req *protocol.RequestAddFriend) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessAddFriend(req *protocol.RequestAddFriend) (*protocol.ReplyGeneric, *protocol.ResponseError) {
 	var (
 		err      error
 		friendId uint64
 	)
 
+	if errReply := ctx.checkEmailVerified(); errReply != nil {
+		return nil, errReply
+	}
+
 	if friendId, err = strconv.ParseUint(req.FriendId, 10, 64); err != nil {
-		return &protocol.ResponseError{UserMsg: "Friend id is not numeric"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Friend id is not numeric"}
 	}
 
 	if friendId == ctx.UserId {
-		return &protocol.ResponseError{UserMsg: "You cannot add yourself as a friend"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "You cannot add yourself as a friend"}
 	}
 
-	if _, err = db.AddFriendsRequestStmt.Exec(ctx.UserId, friendId, 1); err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not add user as a friend", Err: err}
+	if _, err = db.AddFriendsRequestStmt.ExecContext(ctx.Context, ctx.UserId, friendId, 1); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not add user as a friend", Err: err}
 	}
 
-	if _, err = db.AddFriendsRequestStmt.Exec(friendId, ctx.UserId, 0); err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not add user as a friend", Err: err}
+	if _, err = db.AddFriendsRequestStmt.ExecContext(ctx.Context, friendId, ctx.UserId, 0); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not add user as a friend", Err: err}
 	}
 
 	ev := &events.EventFriendRequest{}
@@ -269,39 +311,39 @@ func (ctx *WebsocketCtx) ProcessAddFriend(req *protocol.RequestAddFriend) protoc
 	reply := new(protocol.ReplyGeneric)
 	reply.Success = true
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessConfirmFriendship(req *protocol.RequestConfirmFriendship) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessConfirmFriendship(req *protocol.RequestConfirmFriendship) (*protocol.ReplyGeneric, *protocol.ResponseError) {
 	var (
 		err      error
 		friendId uint64
 	)
 
 	if friendId, err = strconv.ParseUint(req.FriendId, 10, 64); err != nil {
-		return &protocol.ResponseError{UserMsg: "Friend id is not numeric"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Friend id is not numeric"}
 	}
 
-	if _, err = db.ConfirmFriendshipStmt.Exec(ctx.UserId, friendId); err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not confirm friendship", Err: err}
+	if _, err = db.ConfirmFriendshipStmt.ExecContext(ctx.Context, ctx.UserId, friendId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not confirm friendship", Err: err}
 	}
 
 	reply := new(protocol.ReplyGeneric)
 	reply.Success = true
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetMessagesUsers(req *protocol.RequestGetMessagesUsers) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetMessagesUsers(req *protocol.RequestGetMessagesUsers) (*protocol.ReplyGetMessagesUsers, *protocol.ResponseError) {
 	var (
 		err error
 		id  uint64
 		ts  string
 	)
 
-	rows, err := db.GetMessagesUsersStmt.Query(ctx.UserId, req.Limit)
+	rows, err := db.GetMessagesUsersStmt.QueryContext(ctx.Context, ctx.UserId, req.Limit)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get users list for messages", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get users list for messages", Err: err}
 	}
 
 	defer rows.Close()
@@ -314,7 +356,7 @@ func (ctx *WebsocketCtx) ProcessGetMessagesUsers(req *protocol.RequestGetMessage
 
 	for rows.Next() {
 		if err := rows.Scan(&id, &ts); err != nil {
-			return &protocol.ResponseError{UserMsg: "Could not get users list for messages", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get users list for messages", Err: err}
 		}
 
 		usersMap[id] = true
@@ -324,9 +366,9 @@ func (ctx *WebsocketCtx) ProcessGetMessagesUsers(req *protocol.RequestGetMessage
 		userIds = append(userIds, userId)
 	}
 
-	friendIds, err := db.GetUserFriends(ctx.UserId)
+	friendIds, err := db.GetUserFriends(ctx.Context, ctx.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get users list for messages", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get users list for messages", Err: err}
 	}
 
 	for _, friendId := range friendIds {
@@ -339,107 +381,166 @@ func (ctx *WebsocketCtx) ProcessGetMessagesUsers(req *protocol.RequestGetMessage
 		userIds = append(userIds, userId)
 	}
 
-	userNames, err := db.GetUserNames(userIds)
+	userNames, err := db.GetUserNames(ctx.Context, userIds)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get users list for messages", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get users list for messages", Err: err}
 	}
 
 	for i, user := range reply.Users {
 		reply.Users[i].Name = userNames[user.Id]
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetProfile(req *protocol.RequestGetProfile) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetProfile(req *protocol.RequestGetProfile) (*protocol.ReplyGetProfile, *protocol.ResponseError) {
 	reply := new(protocol.ReplyGetProfile)
 
 	userIdStr := fmt.Sprint(req.UserId)
-	userNames, err := db.GetUserNames([]string{userIdStr})
+	userNames, err := db.GetUserNames(ctx.Context, []string{userIdStr})
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get user profile", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get user profile", Err: err}
 	}
 
 	if len(userNames) == 0 {
-		return &protocol.ResponseError{UserMsg: "No such user", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_NOT_FOUND, UserMsg: "No such user", Err: err}
 	}
 
 	reply.Name = userNames[userIdStr]
 
-	row, err := db.GetProfileStmt.Query(req.UserId)
+	row, err := db.GetProfileStmt.QueryContext(ctx.Context, req.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get user profile", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get user profile", Err: err}
 	}
 	defer row.Close()
 
 	var birthdate time.Time
 	if !row.Next() {
-		return reply
+		return reply, nil
 	}
 
 	err = row.Scan(&reply.Name, &birthdate, &reply.Sex, &reply.Description, &reply.CityId, &reply.FamilyPosition)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get user profile", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get user profile", Err: err}
 	}
 
 	reply.Birthdate = birthdate.Format(dateFormat)
 
-	city, err := db.GetCityInfo(reply.CityId)
+	city, err := db.GetCityInfo(ctx.Context, reply.CityId)
 	if err != nil {
 		log.Printf("Could not get city by id=%d for user id=%d", reply.CityId, req.UserId)
 		city = &db.City{}
 	}
 
-	reply.FriendsCount, err = db.GetUserFriendsCount(req.UserId)
+	reply.FriendsCount, err = db.GetUserFriendsCount(ctx.Context, req.UserId)
 	if err != nil {
 		log.Printf("Could not get friends count for user %d: %s", req.UserId, err.Error())
 	}
 
-	reply.IsFriend, reply.RequestAccepted, err = db.IsUserFriend(ctx.UserId, req.UserId)
+	reply.IsFriend, reply.RequestAccepted, err = db.IsUserFriend(ctx.Context, ctx.UserId, req.UserId)
 	if err != nil {
 		log.Printf("Could not get information about friendship for user %d: %s", req.UserId, err.Error())
 	}
 
 	reply.CityName = city.Name
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessUpdateProfile(req *protocol.RequestUpdateProfile) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessUpdateProfile(req *protocol.RequestUpdateProfile) (*protocol.ReplyGeneric, *protocol.ResponseError) {
 	reply := new(protocol.ReplyGeneric)
 	reply.Success = true
 
 	if req.CityName == "" || req.Birthdate == "" || req.Name == "" {
-		return &protocol.ResponseError{UserMsg: "All fields must be filled in"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "All fields must be filled in"}
 	}
 
 	var cityId uint64
-	city, err := db.GetCityInfoByName(req.CityName)
+	city, err := db.GetCityInfoByName(ctx.Context, req.CityName)
 	if err != nil {
-		res := db.AddCityStmt.QueryRow(req.CityName, 0, 0)
+		res := db.AddCityStmt.QueryRowContext(ctx.Context, req.CityName, 0, 0)
 		if err = res.Scan(&cityId); err != nil {
-			return &protocol.ResponseError{UserMsg: "Could not update user profile", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not update user profile", Err: err}
 		}
 	} else {
 		cityId = city.Id
 	}
 
-	row, err := db.GetProfileStmt.Query(ctx.UserId)
+	row, err := db.GetProfileStmt.QueryContext(ctx.Context, ctx.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not update user profile", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not update user profile", Err: err}
 	}
 	defer row.Close()
 
 	if !row.Next() {
-		_, err := db.AddProfileStmt.Exec(&ctx.UserId, &req.Name, &req.Birthdate, &req.Sex, "", &cityId, &req.FamilyPosition)
+		_, err := db.AddProfileStmt.ExecContext(ctx.Context, &ctx.UserId, &req.Name, &req.Birthdate, &req.Sex, "", &cityId, &req.FamilyPosition)
 		if err != nil {
-			return &protocol.ResponseError{UserMsg: "Could not update user profile", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not update user profile", Err: err}
 		}
 	} else {
-		_, err := db.UpdateProfileStmt.Exec(&req.Name, &req.Birthdate, &req.Sex, "", &cityId, &req.FamilyPosition, &ctx.UserId)
+		_, err := db.UpdateProfileStmt.ExecContext(ctx.Context, &req.Name, &req.Birthdate, &req.Sex, "", &cityId, &req.FamilyPosition, &ctx.UserId)
 		if err != nil {
-			return &protocol.ResponseError{UserMsg: "Could not update user profile", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not update user profile", Err: err}
 		}
 	}
 
-	return reply
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessGetSessions(req *protocol.RequestGetSessions) (*protocol.ReplyGetSessions, *protocol.ResponseError) {
+	sessions, err := session.GetUserSessions(ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get sessions", Err: err}
+	}
+
+	reply := new(protocol.ReplyGetSessions)
+	reply.Sessions = make([]protocol.JSSessionInfo, 0, len(sessions))
+
+	for _, s := range sessions {
+		reply.Sessions = append(reply.Sessions, protocol.JSSessionInfo{
+			Id:         session.Handle(s.SessionId),
+			CreatedTs:  fmt.Sprint(s.CreatedTs),
+			LastSeenTs: fmt.Sprint(s.LastSeenTs),
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			Current:    s.SessionId == ctx.SessionId,
+		})
+	}
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessRevokeSession(req *protocol.RequestRevokeSession) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	sessions, err := session.GetUserSessions(ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not revoke session", Err: err}
+	}
+
+	var sessionId string
+	for _, s := range sessions {
+		if session.Handle(s.SessionId) == req.Id {
+			sessionId = s.SessionId
+			break
+		}
+	}
+
+	if sessionId == "" {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_NOT_FOUND, UserMsg: "No such session"}
+	}
+
+	if err = session.DeleteSession(sessionId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not revoke session", Err: err}
+	}
+
+	events.EventsFlow <- &events.ControlEvent{
+		EvType: events.EVENT_SESSION_REVOKED,
+		Info: &events.InternalEventSessionRevoked{
+			UserId:    ctx.UserId,
+			SessionId: sessionId,
+		},
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
 }
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+type (
+	// Handler processes decoded request, req is the pointer to protocol.RequestXXX
+	Handler func(ctx *WebsocketCtx, reqType string, req interface{}) protocol.Reply
+
+	// Interceptor wraps every Process call both for websocket and HTTP API.
+	// It can reply on its own without calling next, e.g. to reject the request.
+	Interceptor func(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply
+)
+
+var (
+	interceptors []Interceptor
+
+	// Exported at /debug/vars, times are in microseconds
+	requestsCount = expvar.NewMap("requests")
+	requestsTime  = expvar.NewMap("requests_time_us")
+	requestsError = expvar.NewMap("requests_error")
+)
+
+// Use adds interceptors to the end of the chain, the first one is the outermost.
+// It must only be called on startup before any requests are processed.
+func Use(i ...Interceptor) {
+	interceptors = append(interceptors, i...)
+}
+
+func chain(list []Interceptor, h Handler) Handler {
+	for i := len(list) - 1; i >= 0; i-- {
+		interceptor, next := list[i], h
+		h = func(ctx *WebsocketCtx, reqType string, req interface{}) protocol.Reply {
+			return interceptor(ctx, reqType, req, next)
+		}
+	}
+
+	return h
+}
+
+// LoggingInterceptor logs every request and the internal error behind error replies
+func LoggingInterceptor(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+	start := time.Now()
+	resp := next(ctx, reqType, req)
+
+	log.Printf("Processed %s, %+v in %s", reqType, req, time.Since(start))
+
+	if v, ok := resp.(*protocol.ResponseError); ok && v.Err != nil {
+		log.Println(reqType, ":", v.Err.Error())
+	}
+
+	return resp
+}
+
+// RecoveryInterceptor turns panics into internal errors, so one bad request does not bring the server down
+func RecoveryInterceptor(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) (resp protocol.Reply) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Internal error", Err: fmt.Errorf("Panic on request: %s %v", reqType, r)}
+		}
+	}()
+
+	return next(ctx, reqType, req)
+}
+
+// TimingInterceptor counts requests, errors and total processing time per request type
+func TimingInterceptor(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+	start := time.Now()
+	resp := next(ctx, reqType, req)
+
+	requestsCount.Add(reqType, 1)
+	requestsTime.Add(reqType, int64(time.Since(start)/time.Microsecond))
+
+	if _, ok := resp.(*protocol.ResponseError); ok {
+		requestsError.Add(reqType, 1)
+	}
+
+	return resp
+}
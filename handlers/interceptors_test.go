@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+
+	record := func(name string) Interceptor {
+		return func(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+			calls = append(calls, name)
+			return next(ctx, reqType, req)
+		}
+	}
+
+	h := chain([]Interceptor{record("first"), record("second"), RecoveryInterceptor}, func(ctx *WebsocketCtx, reqType string, req interface{}) protocol.Reply {
+		calls = append(calls, "handler")
+		panic("oops")
+	})
+
+	resp := h(&WebsocketCtx{}, "REQUEST_GET_FRIENDS", nil)
+
+	if v, ok := resp.(*protocol.ResponseError); !ok || v.UserMsg != "Internal error" || v.Err == nil {
+		t.Errorf("Panic must be turned into internal error, got %+v", resp)
+	}
+
+	if len(calls) != 3 || calls[0] != "first" || calls[1] != "second" || calls[2] != "handler" {
+		t.Errorf("Unexpected call order: %v", calls)
+	}
+}
+
+func TestChainShortCircuit(t *testing.T) {
+	reject := func(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+		return &protocol.ResponseError{UserMsg: "Rejected"}
+	}
+
+	h := chain([]Interceptor{reject}, func(ctx *WebsocketCtx, reqType string, req interface{}) protocol.Reply {
+		t.Fatalf("Handler must not be called")
+		return nil
+	})
+
+	if v, ok := h(&WebsocketCtx{}, "REQUEST_GET_FRIENDS", nil).(*protocol.ResponseError); !ok || v.UserMsg != "Rejected" {
+		t.Errorf("Interceptor reply must be returned")
+	}
+}
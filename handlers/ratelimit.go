@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/ratelimit"
+)
+
+const (
+	defaultRequestsPerSecond     = 20
+	defaultUserRequestsPerSecond = 50
+
+	// Clients can make this many times more requests at once than per second
+	rateLimitBurst = 2
+)
+
+// Requests that are expensive for the database or disturb other users cost more than one token.
+// Items of REQUEST_BATCH are charged separately in addition to the batch itself.
+var requestWeights = map[string]float64{
+	"REQUEST_GET_USERS_LIST":   2,
+	"REQUEST_SEND_MESSAGE":     5,
+	"REQUEST_ADD_FRIEND":       5,
+	"REQUEST_CREATE_API_TOKEN": 5,
+	"REQUEST_ADD_TO_TIMELINE":  10,
+	"REQUEST_EXPORT_DATA":      10,
+	"REQUEST_CHANGE_PASSWORD":  10,
+	"REQUEST_CHANGE_EMAIL":     10,
+	"REQUEST_DELETE_ACCOUNT":   10,
+}
+
+// Shared by all connections and HTTP API requests of the user, nil until InitRateLimits is called
+var userRateLimits *ratelimit.Buckets
+
+func requestsPerSecond() float64 {
+	if config.Conf.RequestsPerSecond == 0 {
+		return defaultRequestsPerSecond
+	}
+
+	return float64(config.Conf.RequestsPerSecond)
+}
+
+func userRequestsPerSecond() float64 {
+	if config.Conf.UserRequestsPerSecond == 0 {
+		return defaultUserRequestsPerSecond
+	}
+
+	return float64(config.Conf.UserRequestsPerSecond)
+}
+
+func InitRateLimits() {
+	userRateLimits = ratelimit.NewBuckets(userRequestsPerSecond(), userRequestsPerSecond()*rateLimitBurst)
+}
+
+// NewConnectionRateLimit returns the bucket for WebsocketCtx.RateLimit of a new websocket connection
+func NewConnectionRateLimit() *ratelimit.Bucket {
+	return ratelimit.NewBucket(requestsPerSecond(), requestsPerSecond()*rateLimitBurst)
+}
+
+func requestWeight(reqType string) float64 {
+	if w, ok := requestWeights[reqType]; ok {
+		return w
+	}
+
+	return 1
+}
+
+// RateLimitInterceptor rejects requests when either connection or user has run out of tokens
+func RateLimitInterceptor(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+	weight := requestWeight(reqType)
+
+	if ctx.RateLimit != nil && !ctx.RateLimit.Take(weight) {
+		return &protocol.ResponseError{Code: protocol.ERROR_RATE_LIMITED, UserMsg: "Too many requests, try again later"}
+	}
+
+	if userRateLimits != nil && !userRateLimits.Take(ctx.UserId, weight) {
+		return &protocol.ResponseError{Code: protocol.ERROR_RATE_LIMITED, UserMsg: "Too many requests from your account, try again later"}
+	}
+
+	return next(ctx, reqType, req)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/ratelimit"
+)
+
+func TestRateLimitInterceptor(t *testing.T) {
+	ctx := &WebsocketCtx{RateLimit: ratelimit.NewBucket(0, 6)}
+	ok := func(ctx *WebsocketCtx, reqType string, req interface{}) protocol.Reply {
+		return new(protocol.ReplyGeneric)
+	}
+
+	if _, isErr := RateLimitInterceptor(ctx, "REQUEST_SEND_MESSAGE", nil, ok).(*protocol.ResponseError); isErr {
+		t.Fatalf("First request must not be limited")
+	}
+
+	v, isErr := RateLimitInterceptor(ctx, "REQUEST_SEND_MESSAGE", nil, ok).(*protocol.ResponseError)
+	if !isErr || v.Code != protocol.ERROR_RATE_LIMITED {
+		t.Fatalf("Request that costs more than what is left must be limited")
+	}
+
+	if _, isErr := RateLimitInterceptor(ctx, "REQUEST_GET_FRIENDS", nil, ok).(*protocol.ResponseError); isErr {
+		t.Fatalf("Cheap request must still be allowed")
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+// AddSecurityEvent records an event that account owner should know about
+func AddSecurityEvent(ctx context.Context, userId uint64, evType, ip string) error {
+	_, err := db.AddSecurityEventStmt.ExecContext(ctx, userId, evType, ip, time.Now().UnixNano())
+	return err
+}
+
+func (ctx *WebsocketCtx) ProcessGetSecurityEvents(req *protocol.RequestGetSecurityEvents) (*protocol.ReplyGetSecurityEvents, *protocol.ResponseError) {
+	limit := req.Limit
+	if limit > protocol.MAX_SECURITY_EVENTS_LIMIT {
+		limit = protocol.MAX_SECURITY_EVENTS_LIMIT
+	}
+
+	if limit <= 0 {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
+	}
+
+	rows, err := db.GetSecurityEventsStmt.QueryContext(ctx.Context, ctx.UserId, limit)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get security events", Err: err}
+	}
+	defer rows.Close()
+
+	reply := new(protocol.ReplyGetSecurityEvents)
+	reply.Events = make([]protocol.JSSecurityEvent, 0)
+
+	for rows.Next() {
+		var ev protocol.JSSecurityEvent
+		var ts int64
+
+		if err = rows.Scan(&ev.Type, &ev.IP, &ts); err != nil {
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get security events", Err: err}
+		}
+
+		ev.Ts = fmt.Sprint(ts)
+		reply.Events = append(reply.Events, ev)
+	}
+
+	return reply, nil
+}
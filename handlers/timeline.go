@@ -15,8 +15,8 @@ import (
 	"github.com/cockroachdb/cockroach-go/crdb"
 )
 
-func getTimelineIDsForHash(hashID, dateEnd, limit uint64) (ids []uint64, err error) {
-	rows, err := db.Db.Query(fmt.Sprintf(`SELECT timeline_id
+func getTimelineIDsForHash(ctx context.Context, hashID, dateEnd, limit uint64) (ids []uint64, err error) {
+	rows, err := db.Db.QueryContext(ctx, fmt.Sprintf(`SELECT timeline_id
 		FROM hashtimeline
 		WHERE hash_id = %d AND ts < %d
 		ORDER BY ts DESC
@@ -37,7 +37,7 @@ func getTimelineIDsForHash(hashID, dateEnd, limit uint64) (ids []uint64, err err
 	return ids, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetTimelineForHash(req *protocol.RequestGetTimelineForHash) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetTimelineForHash(req *protocol.RequestGetTimelineForHash) (*protocol.ReplyGetTimeline, *protocol.ResponseError) {
 	dateEnd := req.DateEnd
 
 	if dateEnd == 0 {
@@ -50,20 +50,20 @@ func (ctx *WebsocketCtx) ProcessGetTimelineForHash(req *protocol.RequestGetTimel
 	}
 
 	if limit <= 0 {
-		return &protocol.ResponseError{UserMsg: "Limit must be greater than 0"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
 	}
 
-	hashIDMap, err := getHashIDs(db.Db, []string{req.Hash})
+	hashIDMap, err := getHashIDs(ctx.Context, db.Db, []string{req.Hash})
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Internal error while getting hashes", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Internal error while getting hashes", Err: err}
 	}
 
-	timelineIDs, err := getTimelineIDsForHash(hashIDMap[req.Hash], dateEnd, limit)
+	timelineIDs, err := getTimelineIDsForHash(ctx.Context, hashIDMap[req.Hash], dateEnd, limit)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Internal error while getting timeline for hashes", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Internal error while getting timeline for hashes", Err: err}
 	}
 
-	return getTimeline(&getTimelineQuery{timelineIDs: timelineIDs})
+	return getTimeline(ctx.Context, &getTimelineQuery{timelineIDs: timelineIDs})
 }
 
 type getTimelineQuery struct {
@@ -75,7 +75,7 @@ type getTimelineQuery struct {
 	limit   uint64
 }
 
-func getTimeline(q *getTimelineQuery) protocol.Reply {
+func getTimeline(ctx context.Context, q *getTimelineQuery) (*protocol.ReplyGetTimeline, *protocol.ResponseError) {
 	var rows *sql.Rows
 	var err error
 
@@ -83,20 +83,20 @@ func getTimeline(q *getTimelineQuery) protocol.Reply {
 	reply.Messages = make([]protocol.TimelineMessage, 0)
 
 	if q.userID != 0 {
-		rows, err = db.GetFromTimelineStmt.Query(q.userID, q.dateEnd, q.limit)
+		rows, err = db.GetFromTimelineStmt.QueryContext(ctx, q.userID, q.dateEnd, q.limit)
 	} else {
 		if len(q.timelineIDs) == 0 {
-			return reply
+			return reply, nil
 		}
 
-		rows, err = db.Db.Query(`SELECT id, source_user_id, message, ts
+		rows, err = db.Db.QueryContext(ctx, `SELECT id, source_user_id, message, ts
 			FROM timeline
-			WHERE id IN(` + db.INuint(q.timelineIDs) + `)
+			WHERE id IN(`+db.INuint(q.timelineIDs)+`)
 			ORDER BY ts DESC`)
 	}
 
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Cannot select timeline", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select timeline", Err: err}
 	}
 
 	userIds := make([]string, 0)
@@ -105,26 +105,26 @@ func getTimeline(q *getTimelineQuery) protocol.Reply {
 	for rows.Next() {
 		var msg protocol.TimelineMessage
 		if err = rows.Scan(&msg.Id, &msg.UserId, &msg.Text, &msg.Ts); err != nil {
-			return &protocol.ResponseError{UserMsg: "Cannot select timeline", Err: err}
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select timeline", Err: err}
 		}
 
 		reply.Messages = append(reply.Messages, msg)
 		userIds = append(userIds, msg.UserId)
 	}
 
-	userNames, err := db.GetUserNames(userIds)
+	userNames, err := db.GetUserNames(ctx, userIds)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Cannot select timeline", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Cannot select timeline", Err: err}
 	}
 
 	for i, row := range reply.Messages {
 		reply.Messages[i].UserName = userNames[row.UserId]
 	}
 
-	return reply
+	return reply, nil
 }
 
-func (ctx *WebsocketCtx) ProcessGetTimeline(req *protocol.RequestGetTimeline) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessGetTimeline(req *protocol.RequestGetTimeline) (*protocol.ReplyGetTimeline, *protocol.ResponseError) {
 	dateEnd := req.DateEnd
 
 	if dateEnd == "" {
@@ -137,17 +137,17 @@ func (ctx *WebsocketCtx) ProcessGetTimeline(req *protocol.RequestGetTimeline) pr
 	}
 
 	if limit <= 0 {
-		return &protocol.ResponseError{UserMsg: "Limit must be greater than 0"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Limit must be greater than 0"}
 	}
 
-	return getTimeline(&getTimelineQuery{
+	return getTimeline(ctx.Context, &getTimelineQuery{
 		userID:  ctx.UserId,
 		dateEnd: dateEnd,
 		limit:   limit,
 	})
 }
 
-func insertTimeline(tx *sql.Tx, userID uint64, userIDs []uint64, text string, now int64) (ids []uint64, err error) {
+func insertTimeline(ctx context.Context, tx *sql.Tx, userID uint64, userIDs []uint64, text string, now int64) (ids []uint64, err error) {
 	var args = make([]interface{}, 0, len(userIDs)*4)
 	var values = make([]string, 0, len(userIDs))
 
@@ -162,7 +162,8 @@ func insertTimeline(tx *sql.Tx, userID uint64, userIDs []uint64, text string, no
 		args = append(args, uid, userID, text, now)
 	}
 
-	rows, err := tx.Query(
+	rows, err := tx.QueryContext(
+		ctx,
 		`INSERT INTO timeline
 		(user_id, source_user_id, message, ts)
 		VALUES `+strings.Join(values, ", ")+`
@@ -199,14 +200,14 @@ func extractHashTags(text string) (result []string) {
 	return result
 }
 
-func getHashIDs(tx db.Querier, hashtags []string) (map[string]uint64, error) {
+func getHashIDs(ctx context.Context, tx db.Querier, hashtags []string) (map[string]uint64, error) {
 	if len(hashtags) == 0 {
 		return nil, nil
 	}
 
 	res := make(map[string]uint64, len(hashtags))
 
-	rows, err := tx.Query(`SELECT id, name FROM hashes WHERE name IN(` + db.INstr(hashtags) + `)`)
+	rows, err := tx.QueryContext(ctx, `SELECT id, name FROM hashes WHERE name IN(`+db.INstr(hashtags)+`)`)
 	if err != nil {
 		return nil, err
 	}
@@ -226,13 +227,13 @@ func getHashIDs(tx db.Querier, hashtags []string) (map[string]uint64, error) {
 	return res, nil
 }
 
-func getOrCreateHashIDs(tx *sql.Tx, hashtags []string) (map[string]uint64, error) {
+func getOrCreateHashIDs(ctx context.Context, tx *sql.Tx, hashtags []string) (map[string]uint64, error) {
 	missing := make(map[string]struct{}, len(hashtags))
 	for _, tag := range hashtags {
 		missing[tag] = struct{}{}
 	}
 
-	nameToIDMap, err := getHashIDs(tx, hashtags)
+	nameToIDMap, err := getHashIDs(ctx, tx, hashtags)
 	if err != nil {
 		return nil, err
 	}
@@ -250,7 +251,7 @@ func getOrCreateHashIDs(tx *sql.Tx, hashtags []string) (map[string]uint64, error
 		values = append(values, fmt.Sprintf(`('%s')`, db.Escape(name)))
 	}
 
-	rows, err := tx.Query(`INSERT INTO hashes(name) VALUES ` + strings.Join(values, ", ") + ` RETURNING id, name`)
+	rows, err := tx.QueryContext(ctx, `INSERT INTO hashes(name) VALUES `+strings.Join(values, ", ")+` RETURNING id, name`)
 	if err != nil {
 		return nil, err
 	}
@@ -270,45 +271,49 @@ func getOrCreateHashIDs(tx *sql.Tx, hashtags []string) (map[string]uint64, error
 	return nameToIDMap, nil
 }
 
-func insertHashTimeline(tx *sql.Tx, timelineID uint64, hashIDs []uint64, now int64) error {
+func insertHashTimeline(ctx context.Context, tx *sql.Tx, timelineID uint64, hashIDs []uint64, now int64) error {
 	values := make([]string, 0, len(hashIDs))
 	for _, id := range hashIDs {
 		values = append(values, fmt.Sprintf(`(%d, %d, %d)`, id, timelineID, now))
 	}
 
-	_, err := tx.Exec(`INSERT INTO hashtimeline(hash_id, timeline_id, ts)
-		VALUES ` + strings.Join(values, ", "))
+	_, err := tx.ExecContext(ctx, `INSERT INTO hashtimeline(hash_id, timeline_id, ts)
+		VALUES `+strings.Join(values, ", "))
 	return err
 }
 
-func (ctx *WebsocketCtx) ProcessAddToTimeline(req *protocol.RequestAddToTimeline) protocol.Reply {
+func (ctx *WebsocketCtx) ProcessAddToTimeline(req *protocol.RequestAddToTimeline) (*protocol.ReplyGeneric, *protocol.ResponseError) {
 	var (
 		err error
 		now = time.Now().UnixNano()
 	)
 
+	if errReply := ctx.checkEmailVerified(); errReply != nil {
+		return nil, errReply
+	}
+
 	if len(req.Text) == 0 {
-		return &protocol.ResponseError{UserMsg: "Text must not be empty"}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Text must not be empty"}
 	} else if utf8.RuneCountInString(req.Text) > maxTimelineLength {
-		return &protocol.ResponseError{UserMsg: fmt.Sprintf("Text cannot exceed %d characters", maxTimelineLength)}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: fmt.Sprintf("Text cannot exceed %d characters", maxTimelineLength)}
 	}
 
 	hashTags := extractHashTags(req.Text)
 
-	userIds, err := db.GetUserFriends(ctx.UserId)
+	userIds, err := db.GetUserFriends(ctx.Context, ctx.UserId)
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not get user ids", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get user ids", Err: err}
 	}
 
 	userIds = append(userIds, ctx.UserId)
 
-	err = crdb.ExecuteTx(context.Background(), db.Db, nil, func(tx *sql.Tx) error {
-		ids, err := insertTimeline(tx, ctx.UserId, userIds, req.Text, now)
+	err = crdb.ExecuteTx(ctx.Context, db.Db, nil, func(tx *sql.Tx) error {
+		ids, err := insertTimeline(ctx.Context, tx, ctx.UserId, userIds, req.Text, now)
 		if err != nil {
 			return err
 		}
 
-		nameToIDMap, err := getOrCreateHashIDs(tx, hashTags)
+		nameToIDMap, err := getOrCreateHashIDs(ctx.Context, tx, hashTags)
 		if err != nil {
 			return err
 		}
@@ -322,7 +327,7 @@ func (ctx *WebsocketCtx) ProcessAddToTimeline(req *protocol.RequestAddToTimeline
 			hashIDs = append(hashIDs, id)
 		}
 
-		if err := insertHashTimeline(tx, ids[0], hashIDs, now); err != nil {
+		if err := insertHashTimeline(ctx.Context, tx, ids[0], hashIDs, now); err != nil {
 			return err
 		}
 
@@ -330,7 +335,7 @@ func (ctx *WebsocketCtx) ProcessAddToTimeline(req *protocol.RequestAddToTimeline
 	})
 
 	if err != nil {
-		return &protocol.ResponseError{UserMsg: "Could not add to timeline", Err: err}
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not add to timeline", Err: err}
 	}
 
 	reply := new(protocol.ReplyGeneric)
@@ -348,5 +353,5 @@ func (ctx *WebsocketCtx) ProcessAddToTimeline(req *protocol.RequestAddToTimeline
 		},
 	}
 
-	return reply
+	return reply, nil
 }
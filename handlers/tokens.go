@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+const (
+	apiTokenPrefix = "sn_"
+	apiTokenBytes  = 32
+
+	maxApiTokenNameLength = 255
+)
+
+// Requests that manage credentials can only be made from a logged in session,
+// otherwise a leaked token could be used to create new tokens or lock the owner out
+var sessionOnlyRequests = map[string]bool{
+	"REQUEST_GET_SESSIONS":          true,
+	"REQUEST_REVOKE_SESSION":        true,
+	"REQUEST_ENROLL_TOTP":           true,
+	"REQUEST_CONFIRM_TOTP":          true,
+	"REQUEST_DISABLE_TOTP":          true,
+	"REQUEST_CREATE_API_TOKEN":      true,
+	"REQUEST_GET_API_TOKENS":        true,
+	"REQUEST_REVOKE_API_TOKEN":      true,
+	"REQUEST_GET_SECURITY_EVENTS":   true,
+	"REQUEST_DELETE_ACCOUNT":        true,
+	"REQUEST_CANCEL_DELETE_ACCOUNT": true,
+	"REQUEST_EXPORT_DATA":           true,
+	"REQUEST_CHANGE_PASSWORD":       true,
+	"REQUEST_CHANGE_EMAIL":          true,
+}
+
+// Requests that only describe the server are allowed for any token
+var publicRequests = map[string]bool{
+	"REQUEST_DESCRIBE": true,
+	"REQUEST_HELLO":    true,
+}
+
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ScopeAllows reports whether token with given scopes can make request of type reqType
+func ScopeAllows(scopes []string, reqType string) bool {
+	if sessionOnlyRequests[reqType] {
+		return false
+	} else if publicRequests[reqType] {
+		return true
+	}
+
+	for _, scope := range scopes {
+		switch {
+		case scope == protocol.SCOPE_ALL:
+			return true
+		case scope == protocol.SCOPE_READ && strings.HasPrefix(reqType, "REQUEST_GET_"):
+			return true
+		case scope == reqType:
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScopeInterceptor rejects requests that the API token is not allowed to make,
+// requests from logged in sessions are not restricted
+func ScopeInterceptor(ctx *WebsocketCtx, reqType string, req interface{}, next Handler) protocol.Reply {
+	if ctx.TokenId != 0 && !ScopeAllows(ctx.Scopes, reqType) {
+		return &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Token is not allowed to make " + reqType}
+	}
+
+	return next(ctx, reqType, req)
+}
+
+func validScope(scope string) bool {
+	return scope == protocol.SCOPE_ALL || scope == protocol.SCOPE_READ || strings.HasPrefix(scope, "REQUEST_")
+}
+
+// AuthenticateToken returns session info for the API token, or nil if token is not valid
+func AuthenticateToken(ctx context.Context, token string) (*session.SessionInfo, error) {
+	var (
+		scopes string
+		info   = new(session.SessionInfo)
+	)
+
+	err := db.GetApiTokenStmt.QueryRowContext(ctx, apiTokenHash(token)).Scan(&info.TokenId, &info.Id, &scopes, &info.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	info.Scopes = strings.Split(scopes, ",")
+
+	if _, err := db.TouchApiTokenStmt.ExecContext(ctx, time.Now().UnixNano(), info.TokenId); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (ctx *WebsocketCtx) ProcessCreateApiToken(req *protocol.RequestCreateApiToken) (*protocol.ReplyCreateApiToken, *protocol.ResponseError) {
+	if req.Name == "" || len(req.Name) > maxApiTokenNameLength {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Token name must not be empty or too long"}
+	}
+
+	if len(req.Scopes) == 0 {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Token must have at least one scope"}
+	}
+
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Invalid scope: " + scope}
+		}
+	}
+
+	buf := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not create token", Err: err}
+	}
+
+	token := apiTokenPrefix + hex.EncodeToString(buf)
+
+	var id uint64
+	err := db.AddApiTokenStmt.QueryRowContext(ctx.Context, ctx.UserId, req.Name, apiTokenHash(token), strings.Join(req.Scopes, ","), time.Now().UnixNano()).Scan(&id)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not create token", Err: err}
+	}
+
+	reply := new(protocol.ReplyCreateApiToken)
+	reply.Id = fmt.Sprint(id)
+	reply.Token = token
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessGetApiTokens(req *protocol.RequestGetApiTokens) (*protocol.ReplyGetApiTokens, *protocol.ResponseError) {
+	rows, err := db.GetApiTokensStmt.QueryContext(ctx.Context, ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get tokens", Err: err}
+	}
+	defer rows.Close()
+
+	reply := new(protocol.ReplyGetApiTokens)
+	reply.Tokens = make([]protocol.JSApiToken, 0)
+
+	for rows.Next() {
+		var (
+			t                   protocol.JSApiToken
+			id                  uint64
+			scopes              string
+			createdTs, lastUsed int64
+		)
+
+		if err = rows.Scan(&id, &t.Name, &scopes, &createdTs, &lastUsed); err != nil {
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not get tokens", Err: err}
+		}
+
+		t.Id = fmt.Sprint(id)
+		t.Scopes = strings.Split(scopes, ",")
+		t.CreatedTs = fmt.Sprint(createdTs)
+		t.LastUsedTs = fmt.Sprint(lastUsed)
+
+		reply.Tokens = append(reply.Tokens, t)
+	}
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessRevokeApiToken(req *protocol.RequestRevokeApiToken) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	id, err := strconv.ParseUint(req.Id, 10, 64)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: "Token id is not numeric"}
+	}
+
+	res, err := db.DeleteApiTokenStmt.ExecContext(ctx.Context, id, ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not revoke token", Err: err}
+	}
+
+	if cnt, err := res.RowsAffected(); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not revoke token", Err: err}
+	} else if cnt == 0 {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_NOT_FOUND, UserMsg: "No such token"}
+	}
+
+	events.EventsFlow <- &events.ControlEvent{
+		EvType: events.EVENT_SESSION_REVOKED,
+		Info: &events.InternalEventSessionRevoked{
+			UserId:  ctx.UserId,
+			TokenId: id,
+		},
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
+}
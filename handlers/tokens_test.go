@@ -0,0 +1,26 @@
+package handlers
+
+import "testing"
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scopes  []string
+		reqType string
+		allowed bool
+	}{
+		{[]string{"all"}, "REQUEST_SEND_MESSAGE", true},
+		{[]string{"all"}, "REQUEST_CREATE_API_TOKEN", false},
+		{[]string{"all"}, "REQUEST_CANCEL_DELETE_ACCOUNT", false},
+		{[]string{"read"}, "REQUEST_GET_MESSAGES", true},
+		{[]string{"read"}, "REQUEST_SEND_MESSAGE", false},
+		{[]string{"read"}, "REQUEST_GET_API_TOKENS", false},
+		{[]string{"read", "REQUEST_SEND_MESSAGE"}, "REQUEST_SEND_MESSAGE", true},
+		{[]string{"REQUEST_SEND_MESSAGE"}, "REQUEST_ADD_FRIEND", false},
+	}
+
+	for _, tt := range tests {
+		if res := ScopeAllows(tt.scopes, tt.reqType); res != tt.allowed {
+			t.Fatalf("Unexpected result for %v and %s: got %v, expected %v", tt.scopes, tt.reqType, res, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/protocol"
+	"github.com/YuriyNasretdinov/social-net/totp"
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+const (
+	recoveryCodesCount = 10
+	recoveryCodeBytes  = 5
+)
+
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Recovery codes are random enough, so there is no need for a slow salted hash
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func getTotp(ctx context.Context, userId uint64) (secret string, enabled bool, err error) {
+	err = db.GetTotpStmt.QueryRowContext(ctx, userId).Scan(&secret, &enabled)
+	return
+}
+
+// VerifySecondFactor checks either TOTP code or one of recovery codes, which is
+// invalidated after use. TOTP code is rejected if its time step or a later one was
+// already used, so that a code cannot be replayed while it is still valid.
+func VerifySecondFactor(ctx context.Context, userId uint64, code string) (bool, error) {
+	secret, enabled, err := getTotp(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	if !enabled {
+		return false, nil
+	}
+
+	if step, ok := totp.ValidateStep(secret, code, time.Now()); ok {
+		res, err := db.UseTotpStepStmt.ExecContext(ctx, userId, step)
+		if err != nil {
+			return false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+
+		return n > 0, nil
+	}
+
+	var id uint64
+	err = db.UseRecoveryCodeStmt.QueryRowContext(ctx, userId, recoveryCodeHash(code)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (ctx *WebsocketCtx) ProcessEnrollTotp(req *protocol.RequestEnrollTotp) (*protocol.ReplyEnrollTotp, *protocol.ResponseError) {
+	_, enabled, err := getTotp(ctx.Context, ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not enroll two-factor authentication", Err: err}
+	}
+
+	if enabled {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_FAILED_PRECONDITION, UserMsg: "Two-factor authentication is already enabled"}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not enroll two-factor authentication", Err: err}
+	}
+
+	if _, err = db.SetTotpSecretStmt.ExecContext(ctx.Context, secret, ctx.UserId); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not enroll two-factor authentication", Err: err}
+	}
+
+	reply := new(protocol.ReplyEnrollTotp)
+	reply.Secret = secret
+	reply.Uri = totp.URI(secret, config.Conf.Host, ctx.UserName)
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessConfirmTotp(req *protocol.RequestConfirmTotp) (*protocol.ReplyConfirmTotp, *protocol.ResponseError) {
+	secret, enabled, err := getTotp(ctx.Context, ctx.UserId)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not confirm two-factor authentication", Err: err}
+	}
+
+	if enabled {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_FAILED_PRECONDITION, UserMsg: "Two-factor authentication is already enabled"}
+	} else if secret == "" {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_FAILED_PRECONDITION, UserMsg: "Two-factor authentication enrollment was not started"}
+	}
+
+	step, ok := totp.ValidateStep(secret, req.Code, time.Now())
+	if !ok {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Incorrect code"}
+	}
+
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not confirm two-factor authentication", Err: err}
+		}
+		codes = append(codes, code)
+	}
+
+	err = crdb.ExecuteTx(ctx.Context, db.Db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.Stmt(db.DeleteRecoveryCodesStmt).ExecContext(ctx.Context, ctx.UserId); err != nil {
+			return err
+		}
+
+		for _, code := range codes {
+			if _, err := tx.Stmt(db.AddRecoveryCodeStmt).ExecContext(ctx.Context, ctx.UserId, recoveryCodeHash(code)); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Stmt(db.EnableTotpStmt).ExecContext(ctx.Context, ctx.UserId, step)
+		return err
+	})
+
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not confirm two-factor authentication", Err: err}
+	}
+
+	reply := new(protocol.ReplyConfirmTotp)
+	reply.RecoveryCodes = codes
+
+	return reply, nil
+}
+
+func (ctx *WebsocketCtx) ProcessDisableTotp(req *protocol.RequestDisableTotp) (*protocol.ReplyGeneric, *protocol.ResponseError) {
+	ok, err := VerifySecondFactor(ctx.Context, ctx.UserId, req.Code)
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not disable two-factor authentication", Err: err}
+	}
+
+	if !ok {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_PERMISSION_DENIED, UserMsg: "Incorrect code"}
+	}
+
+	err = crdb.ExecuteTx(ctx.Context, db.Db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.Stmt(db.DeleteRecoveryCodesStmt).ExecContext(ctx.Context, ctx.UserId); err != nil {
+			return err
+		}
+
+		_, err := tx.Stmt(db.DisableTotpStmt).ExecContext(ctx.Context, ctx.UserId)
+		return err
+	})
+
+	if err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INTERNAL, UserMsg: "Could not disable two-factor authentication", Err: err}
+	}
+
+	reply := new(protocol.ReplyGeneric)
+	reply.Success = true
+
+	return reply, nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/mailer"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+const (
+	// Confirms email of a new user
+	VERIFICATION_REGISTER = "verify"
+	// Replaces email of the user with the one in the token
+	VERIFICATION_CHANGE_EMAIL = "change-email"
+
+	verificationLinkTTL = 7 * 24 * time.Hour
+)
+
+// accountStamp changes when email or password of the user changes. Change email links are
+// bound to it, so that changing the password cancels the email change that was not confirmed yet.
+func accountStamp(email, passwordHash string) string {
+	sum := sha256.Sum256([]byte(email + "\n" + passwordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Verification token is a signed "<kind>:<user id>:<expiration ts>:<email>" string, so it
+// does not need to be stored. For VERIFICATION_REGISTER it becomes invalid if user changes email in the meantime.
+// VERIFICATION_CHANGE_EMAIL has account stamp before the email: "<kind>:<user id>:<expiration ts>:<stamp>:<email>".
+func verificationToken(kind string, userId uint64, stamp, email string) string {
+	expires := time.Now().Add(verificationLinkTTL).Unix()
+	if kind == VERIFICATION_CHANGE_EMAIL {
+		return session.Sign(fmt.Sprintf("%s:%d:%d:%s:%s", kind, userId, expires, stamp, email))
+	}
+
+	return session.Sign(fmt.Sprintf("%s:%d:%d:%s", kind, userId, expires, email))
+}
+
+// ParseVerificationToken checks token from the link sent by SendVerificationEmail.
+// stamp is only set for VERIFICATION_CHANGE_EMAIL and must be passed to ConfirmEmailChange.
+func ParseVerificationToken(token string) (kind string, userId uint64, email, stamp string, ok bool) {
+	value, ok := session.Unsign(token)
+	if !ok {
+		return "", 0, "", "", false
+	}
+
+	n := 4
+	if strings.HasPrefix(value, VERIFICATION_CHANGE_EMAIL+":") {
+		n = 5
+	}
+
+	parts := strings.SplitN(value, ":", n)
+	if len(parts) != n || (parts[0] != VERIFICATION_REGISTER && parts[0] != VERIFICATION_CHANGE_EMAIL) {
+		return "", 0, "", "", false
+	}
+
+	userId, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, "", "", false
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", 0, "", "", false
+	}
+
+	if n == 5 {
+		return parts[0], userId, parts[4], parts[3], true
+	}
+
+	return parts[0], userId, parts[3], "", true
+}
+
+// SendVerificationEmail sends link that confirms the email (VERIFICATION_REGISTER) or makes it the new email of the user (VERIFICATION_CHANGE_EMAIL).
+// siteURL is the base for the link, e.g. "https://vbambuke.ru". stamp is only used for VERIFICATION_CHANGE_EMAIL.
+func SendVerificationEmail(kind, siteURL string, userId uint64, name, email, stamp string) error {
+	text := "To confirm your email follow the link below:"
+	if kind == VERIFICATION_CHANGE_EMAIL {
+		text = "To use this address for your account follow the link below:"
+	}
+
+	return mailer.Send(email, "Confirm your email", fmt.Sprintf(
+		"Hello, %s!\n\n%s\n\n%s/verify-email?token=%s\n\n"+
+			"If you did not ask for it, just ignore this email.",
+		name, text, siteURL, url.QueryEscape(verificationToken(kind, userId, stamp, email)),
+	))
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+func TestVerificationToken(t *testing.T) {
+	config.Conf.SessionStore = session.STORE_MEMORY
+	session.InitSession()
+
+	kind, userId, email, stamp, ok := ParseVerificationToken(verificationToken(VERIFICATION_REGISTER, 1, "", "a:b@x.org"))
+	if !ok || kind != VERIFICATION_REGISTER || userId != 1 || email != "a:b@x.org" || stamp != "" {
+		t.Fatalf("Unexpected register token contents: %s %d %s %s %v", kind, userId, email, stamp, ok)
+	}
+
+	oldStamp := accountStamp("old@x.org", "hash")
+	kind, userId, email, stamp, ok = ParseVerificationToken(verificationToken(VERIFICATION_CHANGE_EMAIL, 2, oldStamp, "a:b@x.org"))
+	if !ok || kind != VERIFICATION_CHANGE_EMAIL || userId != 2 || email != "a:b@x.org" || stamp != oldStamp {
+		t.Fatalf("Unexpected change email token contents: %s %d %s %s %v", kind, userId, email, stamp, ok)
+	}
+
+	if accountStamp("old@x.org", "new hash") == oldStamp || accountStamp("other@x.org", "hash") == oldStamp {
+		t.Fatalf("Account stamp must change with password and email")
+	}
+
+	if _, _, _, _, ok := ParseVerificationToken("change-email:2:99999999999:stamp:a@x.org.badsignature"); ok {
+		t.Fatalf("Token with invalid signature must be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+// ProtocolAdapter translates frames of some protocol version to the current one and back,
+// so that handlers only ever deal with the current protocol structs
+type ProtocolAdapter interface {
+	// AdaptRequest is called with raw request JSON before it is decoded
+	AdaptRequest(reqType string, data json.RawMessage) (string, json.RawMessage, error)
+	// AdaptReply is called for every reply and event before it is sent to the client
+	AdaptReply(reply interface{}) interface{}
+}
+
+type currentVersionAdapter struct{}
+
+func (currentVersionAdapter) AdaptRequest(reqType string, data json.RawMessage) (string, json.RawMessage, error) {
+	return reqType, data, nil
+}
+
+func (currentVersionAdapter) AdaptReply(reply interface{}) interface{} {
+	return reply
+}
+
+// When protocol structs change incompatibly, PROTOCOL_VERSION is increased and an adapter
+// for the previous version is added here, so that cached frontends keep working
+var protocolAdapters = map[int]ProtocolAdapter{
+	protocol.PROTOCOL_VERSION: currentVersionAdapter{},
+}
+
+// Features that clients can rely on in addition to the request types listed by REQUEST_DESCRIBE
+var capabilities = []string{
+	"api_tokens",
+	"data_export",
+	"describe",
+	"heartbeat",
+	"http_api",
+	"totp",
+}
+
+// SupportedVersions returns protocol versions that the server can speak, oldest first
+func SupportedVersions() []int {
+	res := make([]int, 0, len(protocolAdapters))
+	for v := range protocolAdapters {
+		res = append(res, v)
+	}
+
+	sort.Ints(res)
+	return res
+}
+
+// ParseVersion parses version from the query string, empty string means that client
+// does not know about versions at all
+func ParseVersion(version string) int {
+	if version == "" {
+		return protocol.DEFAULT_PROTOCOL_VERSION
+	}
+
+	v, err := strconv.Atoi(version)
+	if err != nil || v <= 0 {
+		return -1
+	}
+
+	return v
+}
+
+// AdapterForVersion returns error with the list of supported versions for unknown version
+func AdapterForVersion(version int) (ProtocolAdapter, error) {
+	if adapter, ok := protocolAdapters[version]; ok {
+		return adapter, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported protocol version %d, supported versions: %v", version, SupportedVersions())
+}
+
+// NewHelloReply describes negotiated version and what the server supports
+func NewHelloReply(version int) *protocol.ReplyHello {
+	reply := new(protocol.ReplyHello)
+	reply.Type = "REPLY_HELLO"
+	reply.Version = version
+	reply.SupportedVersions = SupportedVersions()
+	reply.Capabilities = capabilities
+
+	return reply
+}
+
+// Version switch itself happens in the websocket handler, here the version is only checked
+func (ctx *WebsocketCtx) ProcessHello(req *protocol.RequestHello) (*protocol.ReplyHello, *protocol.ResponseError) {
+	version := req.Version
+	if version == 0 {
+		version = protocol.DEFAULT_PROTOCOL_VERSION
+	}
+
+	if _, err := AdapterForVersion(version); err != nil {
+		return nil, &protocol.ResponseError{Code: protocol.ERROR_INVALID_ARGUMENT, UserMsg: err.Error()}
+	}
+
+	return NewHelloReply(version), nil
+}
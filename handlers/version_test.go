@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/YuriyNasretdinov/social-net/protocol"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	if v := ParseVersion(""); v != protocol.DEFAULT_PROTOCOL_VERSION {
+		t.Fatalf("Unexpected default version: %d", v)
+	}
+
+	if _, err := AdapterForVersion(ParseVersion("1")); err != nil {
+		t.Fatalf("Version 1 must be supported: %s", err.Error())
+	}
+
+	for _, v := range []string{"0", "-1", "abc", "100500"} {
+		if _, err := AdapterForVersion(ParseVersion(v)); err == nil {
+			t.Fatalf("Version %q must not be supported", v)
+		}
+	}
+
+	ctx := new(WebsocketCtx)
+	if _, errResp := ctx.ProcessHello(&protocol.RequestHello{Version: 100500}); errResp == nil {
+		t.Fatalf("Hello with unsupported version must fail")
+	}
+
+	hello, errResp := ctx.ProcessHello(&protocol.RequestHello{})
+	if errResp != nil || hello.Version != protocol.DEFAULT_PROTOCOL_VERSION || len(hello.Capabilities) == 0 {
+		t.Fatalf("Unexpected hello reply: %+v", hello)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/handlers"
+	"github.com/YuriyNasretdinov/social-net/session"
+)
+
+const (
+	pendingLoginKind = "pending_login"
+	pendingLoginTTL  = 5 * time.Minute
+)
+
+// Pending login holds session info until the second factor is verified
+type pendingLogin struct {
+	Session *session.SessionInfo
+	// Failed attempts are counted for the same account as in loginUser
+	Account string
+}
+
+var errLoginExpired = errors.New("Your login attempt has expired")
+
+func createPendingLogin(info *session.SessionInfo, account string) (string, error) {
+	contents, err := json.Marshal(&pendingLogin{Session: info, Account: account})
+	if err != nil {
+		return "", err
+	}
+
+	return session.CreateToken(pendingLoginKind, contents, pendingLoginTTL)
+}
+
+// Pending login is consumed on the first attempt, so after entering a wrong code
+// user must enter the password again. Wrong codes count as failed login attempts,
+// and account throttle is only reset after the code is verified, so the password
+// alone does not give unlimited attempts to guess the code.
+func loginSecondFactor(pendingToken, code, ip string) (sessionId string, err error) {
+	contents, err := session.ConsumeToken(pendingLoginKind, pendingToken)
+	if err == session.ErrNotFound {
+		return "", errLoginExpired
+	} else if err != nil {
+		log.Println("Could not get pending login: ", err.Error())
+		return "", errors.New("Sorry, internal error occured while trying to log you in")
+	}
+
+	pending := new(pendingLogin)
+	if err = json.Unmarshal(contents, pending); err != nil || pending.Session == nil {
+		return "", errLoginExpired
+	}
+
+	info := pending.Session
+
+	if err = checkThrottles(map[*session.Throttle]string{loginIPThrottle: ip, loginAccountThrottle: pending.Account}); err != nil {
+		return "", err
+	}
+
+	ok, err := handlers.VerifySecondFactor(context.Background(), info.Id, code)
+	if err != nil {
+		log.Println("Could not verify second factor: ", err.Error())
+		return "", errors.New("Sorry, internal error occured while trying to log you in")
+	} else if !ok {
+		recordLoginFailure(pending.Account, ip, info.Id)
+		return "", errors.New("Incorrect code")
+	}
+
+	if err := loginAccountThrottle.Reset(pending.Account); err != nil {
+		log.Println("Could not reset login throttle: ", err.Error())
+	}
+
+	sessionId, err = session.CreateSession(info)
+	if err != nil {
+		log.Println("Could not create session: ", err.Error())
+		return "", errors.New("Internal error: could not create session")
+	}
+
+	return sessionId, nil
+}
+
+func LoginTotpHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		serveFormPage(loginTotpTpl, w, req)
+		return
+	}
+
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	req.ParseForm()
+	code := strings.TrimSpace(req.Form.Get("code"))
+
+	cookie, err := req.Cookie("pending")
+	if err != nil || cookie.Value == "" {
+		w.Header().Add("Location", "/")
+		w.WriteHeader(302)
+		return
+	}
+
+	setAuthCookie(w, req, "pending", "", time.Time{})
+
+	sessionId, err := loginSecondFactor(cookie.Value, code, clientIP(req))
+	if err != nil {
+		w.Header().Add("Content-type", "text/html; charset=UTF-8")
+		fmt.Fprintf(w, "%s. <a href='/'>Go to login page</a>", html.EscapeString(err.Error()))
+		return
+	}
+
+	setSessionCookie(w, req, sessionId)
+	w.Header().Add("Location", "/")
+	w.WriteHeader(302)
+}
@@ -0,0 +1,33 @@
+package mailer
+
+import (
+	"io"
+	"sync"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+)
+
+// fileMailer writes messages to a file (or stdout) instead of sending them,
+// it is used for development and tests
+type fileMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newFileMailer(w io.Writer) *fileMailer {
+	return &fileMailer{w: w}
+}
+
+func (m *fileMailer) Send(to, subject, body string) error {
+	msg := formatMessage(config.Conf.MailFrom, to, subject, body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.w.Write(msg); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(m.w, "\r\n")
+	return err
+}
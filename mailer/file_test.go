@@ -0,0 +1,23 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	var b bytes.Buffer
+
+	m := newFileMailer(&b)
+	if err := m.Send("user@example.org", "Hello", "Body text"); err != nil {
+		t.Fatalf("Could not send message: %s", err.Error())
+	}
+
+	msg := b.String()
+	for _, s := range []string{"To: user@example.org\r\n", "Subject: Hello\r\n", "\r\n\r\nBody text\r\n"} {
+		if !strings.Contains(msg, s) {
+			t.Fatalf("Message does not contain %q: %q", s, msg)
+		}
+	}
+}
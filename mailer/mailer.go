@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+)
+
+const (
+	MAILER_SMTP = "smtp"
+	MAILER_FILE = "file"
+)
+
+type (
+	Mailer interface {
+		Send(to, subject, body string) error
+	}
+)
+
+var mailer Mailer
+
+func InitMailer() {
+	switch config.Conf.Mailer {
+	case MAILER_SMTP:
+		mailer = newSMTPMailer(config.Conf.SMTPAddr, config.Conf.SMTPUser, config.Conf.SMTPPassword, config.Conf.MailFrom)
+	case "", MAILER_FILE:
+		if config.Conf.MailFile == "" {
+			mailer = newFileMailer(os.Stdout)
+			return
+		}
+
+		fp, err := os.OpenFile(config.Conf.MailFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal("Could not open mail file: " + err.Error())
+		}
+
+		mailer = newFileMailer(fp)
+	default:
+		log.Fatal("Unknown mailer: " + config.Conf.Mailer)
+	}
+}
+
+// Send plain text email using configured mailer
+func Send(to, subject, body string) error {
+	return mailer.Send(to, subject, body)
+}
+
+func formatMessage(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&b, "\r\n%s\r\n", body)
+
+	return b.Bytes()
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+)
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr, user, password, from string) *smtpMailer {
+	m := &smtpMailer{addr: addr, from: from}
+
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return m
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMessage(m.from, to, subject, body))
+}
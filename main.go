@@ -1,33 +1,33 @@
 package main
 
 import (
-	"bufio"
-	"crypto/md5"
-	"crypto/sha1"
+	"context"
 	"crypto/tls"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/YuriyNasretdinov/social-net/config"
 	"github.com/YuriyNasretdinov/social-net/db"
 	"github.com/YuriyNasretdinov/social-net/events"
 	"github.com/YuriyNasretdinov/social-net/handlers"
+	"github.com/YuriyNasretdinov/social-net/mailer"
+	"github.com/YuriyNasretdinov/social-net/password"
 	"github.com/YuriyNasretdinov/social-net/protocol"
 	"github.com/YuriyNasretdinov/social-net/session"
+	"github.com/YuriyNasretdinov/social-net/validate"
 	_ "github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/websocket"
 )
@@ -73,27 +73,137 @@ func AvatarServer(w http.ResponseWriter, req *http.Request) {
 	serveStatic(filepath.Join(config.Conf.AvatarDir, avatarPath(userId)), w)
 }
 
-func loginUser(email, userPassword string) (sessionId string, err error) {
-	var id uint64
-	var password, name string
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// Emails are stored normalized, see migrations/001_lowercase_emails.sql for older users
+func getLoginInfo(email string) (*db.LoginInfo, error) {
+	normalized, err := validate.Email(email)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return db.GetLoginInfo(context.Background(), normalized)
+}
+
+var (
+	loginIPThrottle      = &session.Throttle{Prefix: "login_ip", Threshold: 20}
+	loginAccountThrottle = &session.Throttle{Prefix: "login_account", Threshold: 5}
+	registerIPThrottle   = &session.Throttle{Prefix: "register_ip", Threshold: 10}
+
+	// The same error for unknown email and wrong password so that login form
+	// cannot be used to find out who is registered
+	errIncorrectCredentials = errors.New("Incorrect email or password")
+)
+
+func lockoutError(d time.Duration) error {
+	return fmt.Errorf("Too many attempts, please try again in %s", d.Round(time.Second))
+}
+
+// Returns lockout error if any of throttles is locked for the key. Throttle store errors
+// are only logged because we do not want to lock everyone out when memcache is down.
+func checkThrottles(throttles map[*session.Throttle]string) error {
+	for th, key := range throttles {
+		d, err := th.LockedFor(key)
+		if err != nil {
+			log.Println("Could not check throttle: ", err.Error())
+		} else if d > 0 {
+			return lockoutError(d)
+		}
+	}
+
+	return nil
+}
+
+// userId is zero when there is no user with such email
+func recordLoginFailure(account, ip string, userId uint64) {
+	if _, err := loginIPThrottle.Fail(ip); err != nil {
+		log.Println("Could not record login failure: ", err.Error())
+	}
 
-	err = db.LoginStmt.QueryRow(email).Scan(&id, &password, &name)
+	lockout, err := loginAccountThrottle.Fail(account)
+	if err != nil {
+		log.Println("Could not record login failure: ", err.Error())
+		return
+	}
+
+	if lockout == 0 {
+		return
+	}
+
+	log.Printf("Login for %s is locked out for %s after failed attempt from %s", account, lockout, ip)
+
+	if userId != 0 {
+		if err := handlers.AddSecurityEvent(context.Background(), userId, protocol.SECURITY_EVENT_LOGIN_LOCKOUT, ip); err != nil {
+			log.Println("Could not add security event: ", err.Error())
+		}
+	}
+}
+
+// When user has two-factor authentication enabled, session is not created yet:
+// pendingToken is returned instead and must be passed to loginSecondFactor along with the code
+func loginUser(email, userPassword, ip, userAgent string) (sessionId, pendingToken string, err error) {
+	account := strings.ToLower(strings.TrimSpace(email))
+
+	if err = checkThrottles(map[*session.Throttle]string{loginIPThrottle: ip, loginAccountThrottle: account}); err != nil {
+		return
+	}
+
+	info, err := getLoginInfo(email)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println("Db error: " + err.Error())
 			err = errors.New("Sorry, an internal DB error occured")
 		} else {
-			err = errors.New("You are not registered, sorry")
+			password.Verify(userPassword, password.DummyHash())
+			recordLoginFailure(account, ip, 0)
+			err = errIncorrectCredentials
 		}
 		return
 	}
 
-	if passwordHash(userPassword) != password {
-		err = errors.New("Incorrect password")
+	ok, needsRehash := password.Verify(userPassword, info.Password)
+	if !ok {
+		recordLoginFailure(account, ip, info.Id)
+		err = errIncorrectCredentials
 		return
 	}
 
-	sessionId, err = session.CreateSession(&session.SessionInfo{Id: id, Name: name})
+	// Password alone is not enough to log in with two-factor authentication,
+	// so failed attempts are reset by loginSecondFactor after the code is verified
+	if !info.TotpEnabled {
+		if err := loginAccountThrottle.Reset(account); err != nil {
+			log.Println("Could not reset login throttle: ", err.Error())
+		}
+	}
+
+	if needsRehash {
+		rehashPassword(info.Id, userPassword)
+	}
+
+	if !info.EmailVerified && config.Conf.EmailVerification == config.EMAIL_VERIFICATION_LOGIN {
+		err = errors.New("You must confirm your email first, check your inbox or request a new link at /resend-verification")
+		return
+	}
+
+	sessionInfo := &session.SessionInfo{Id: info.Id, Name: info.Name, IP: ip, UserAgent: userAgent}
+
+	if info.TotpEnabled {
+		pendingToken, err = createPendingLogin(sessionInfo, account)
+		if err != nil {
+			log.Println("Could not create pending login: ", err.Error())
+			err = errors.New("Internal error: could not create session")
+		}
+		return
+	}
+
+	sessionId, err = session.CreateSession(sessionInfo)
 	if err != nil {
 		log.Println("Could not create session: ", err.Error())
 		err = errors.New("Internal error: could not create session")
@@ -103,7 +213,36 @@ func loginUser(email, userPassword string) (sessionId string, err error) {
 	return
 }
 
+// Empty value removes the cookie
+func setAuthCookie(w http.ResponseWriter, req *http.Request, name, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func setSessionCookie(w http.ResponseWriter, req *http.Request, sessionId string) {
+	setAuthCookie(w, req, "id", session.Sign(sessionId), time.Now().Add(365*24*time.Hour))
+}
+
 func LoginHandler(w http.ResponseWriter, req *http.Request) {
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
 	req.ParseForm()
 	email := req.Form.Get("email")
 	userPassword := req.Form.Get("password")
@@ -113,51 +252,77 @@ func LoginHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	sessionId, err := loginUser(email, userPassword)
+	sessionId, pendingToken, err := loginUser(email, userPassword, clientIP(req), req.UserAgent())
 	if err != nil {
+		fmt.Fprintf(w, "%s", err.Error())
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:    "id",
-		Value:   string(sessionId),
-		Path:    "/",
-		Domain:  req.Header.Get("Host"),
-		Expires: time.Now().Add(365 * 24 * time.Hour),
+	if pendingToken != "" {
+		setAuthCookie(w, req, "pending", pendingToken, time.Now().Add(pendingLoginTTL))
+		w.Header().Add("Location", "/login-totp")
+		w.WriteHeader(302)
+		return
 	}
 
-	http.SetCookie(w, cookie)
+	setSessionCookie(w, req, sessionId)
 	w.Header().Add("Location", "/")
 	w.WriteHeader(302)
 }
 
 func LogoutHandler(w http.ResponseWriter, req *http.Request) {
-	http.SetCookie(w, &http.Cookie{Name: "id"})
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	if info := getAuthUserInfo(req.Cookies()); info != nil {
+		if err := session.DeleteSession(info.SessionId); err != nil {
+			log.Println("Could not delete session: ", err.Error())
+		}
+
+		events.EventsFlow <- &events.ControlEvent{
+			EvType: events.EVENT_SESSION_REVOKED,
+			Info: &events.InternalEventSessionRevoked{
+				UserId:    info.Id,
+				SessionId: info.SessionId,
+			},
+		}
+	}
+
+	setAuthCookie(w, req, "id", "", time.Time{})
 	w.Header().Add("Location", "/")
 	w.WriteHeader(302)
 }
 
-func passwordHash(password string) string {
-	sh := sha1.New()
-	io.WriteString(sh, password)
-
-	md := md5.New()
-	io.WriteString(md, password)
+// Upgrade password hash to the current format. Failure is not fatal for login
+// because the old hash still works, so we will just try again next time.
+func rehashPassword(id uint64, userPassword string) {
+	hash, err := password.Hash(userPassword)
+	if err != nil {
+		log.Println("Could not rehash password: ", err.Error())
+		return
+	}
 
-	return fmt.Sprintf("%x:%x", sh.Sum(nil), md.Sum(nil))
+	if _, err := db.UpdatePasswordStmt.Exec(hash, id); err != nil {
+		log.Println("Could not update password hash: ", err.Error())
+	}
 }
 
-func serveAuthPage(sessionInfo *session.SessionInfo, w http.ResponseWriter) {
+func serveAuthPage(sessionInfo *session.SessionInfo, w http.ResponseWriter, req *http.Request) {
 	info := new(struct {
 		session.SessionInfo
 		FriendsRequestsCount int
+		CSRFToken            string
 	})
 
 	info.Id = sessionInfo.Id
 	info.Name = sessionInfo.Name
 	info.FriendsRequestsCount = 0
+	info.CSRFToken = csrfToken(w, req)
 
-	friendsReqs, err := db.GetUserFriendsRequests(sessionInfo.Id)
+	friendsReqs, err := db.GetUserFriendsRequests(req.Context(), sessionInfo.Id)
 	if err != nil {
 		log.Println("Could not get friends requests: ", err.Error())
 	} else {
@@ -172,7 +337,13 @@ func serveAuthPage(sessionInfo *session.SessionInfo, w http.ResponseWriter) {
 func getAuthUserInfo(cookies []*http.Cookie) *session.SessionInfo {
 	for _, cook := range cookies {
 		if cook.Name == "id" && cook.Value != "" {
-			info, err := session.GetSessionInfo(cook.Value)
+			sessionId, ok := session.Unsign(cook.Value)
+			if !ok {
+				log.Println("Get auth info error: invalid cookie signature")
+				continue
+			}
+
+			info, err := session.GetSessionInfo(sessionId)
 			if err == nil {
 				return info
 			} else {
@@ -184,6 +355,28 @@ func getAuthUserInfo(cookies []*http.Cookie) *session.SessionInfo {
 	return nil
 }
 
+// authenticateRequest accepts either "Authorization: Bearer <API token>" header
+// or a session cookie, API token takes precedence when both are present
+func authenticateRequest(req *http.Request) *session.SessionInfo {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return getAuthUserInfo(req.Cookies())
+	}
+
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return nil
+	}
+
+	info, err := handlers.AuthenticateToken(req.Context(), strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		log.Println("Get auth info error: " + err.Error())
+		return nil
+	}
+
+	return info
+}
+
 func IndexHandler(w http.ResponseWriter, req *http.Request) {
 	if req.Host == config.Conf.Host && req.TLS == nil {
 		w.Header().Add("Location", "https://"+req.Host+req.RequestURI)
@@ -193,179 +386,109 @@ func IndexHandler(w http.ResponseWriter, req *http.Request) {
 
 	// validate session
 	if info := getAuthUserInfo(req.Cookies()); info != nil {
-		serveAuthPage(info, w)
+		serveAuthPage(info, w, req)
 		return
 	}
 
-	serveStatic("static/index.html", w)
+	serveFormPage(indexTpl, w, req)
 }
 
-func sendError(seqId int, recvChan chan interface{}, message string) {
-	reply := new(protocol.ReplyError)
-	reply.SeqId = seqId
-	reply.Type = "REPLY_ERROR"
-	reply.Message = message
-
+func sendError(seqId int, recvChan chan interface{}, e *protocol.ResponseError) {
 	events.EventsFlow <- &events.ControlEvent{
 		EvType:   events.EVENT_USER_REPLY,
 		Listener: recvChan,
-		Reply:    reply,
-	}
-}
-
-// REQUEST_GET_MESSAGES => RequestGetMessages
-func convertUnderscoreToCamelCase(in string) string {
-	parts := strings.Split(in, "_")
-	out := make([]string, 0, len(parts))
-	for _, v := range parts {
-		out = append(out, strings.ToUpper(v[0:1]), strings.ToLower(v[1:]))
+		Reply:    e.ToReply(seqId),
 	}
-	return strings.Join(out, "")
-}
-
-// ReplyGetMessages => REPLY_GET_MESSAGES
-func convertCamelCaseToUnderscore(in string) string {
-	out := make([]rune, 0)
-
-	for _, c := range in {
-		if unicode.IsUpper(c) && len(out) > 0 {
-			out = append(out, '_')
-		}
-		out = append(out, unicode.ToUpper(c))
-	}
-
-	return string(out)
 }
 
+// Clients that announce protocol version in the query string, e.g. /events?version=1,
+// get errors as JSON frames and EVENT_HELLO on connect. The others can send REQUEST_HELLO
+// as the first frame or not negotiate at all and get the default version.
+// Clients that reconnect with /events?last_event_id=N get the events they missed or EVENT_RESYNC.
 func WebsocketEventsHandler(ws *websocket.Conn) {
 	var userInfo *session.SessionInfo
 
-	if userInfo = getAuthUserInfo(ws.Request().Cookies()); userInfo == nil {
-		ws.Write([]byte("AUTH_ERROR"))
+	versionParam := ws.Request().URL.Query().Get("version")
+	version := handlers.ParseVersion(versionParam)
+
+	adapter, err := handlers.AdapterForVersion(version)
+	if err != nil {
+		websocket.JSON.Send(ws, protocol.NewReplyError(0, protocol.ERROR_INVALID_ARGUMENT, err.Error()))
 		return
 	}
 
-	//	dupReader := io.TeeReader(ws, os.Stdout)
-	rd := bufio.NewReader(ws)
-	decoder := json.NewDecoder(rd)
-
-	var ctx *handlers.WebsocketCtx
-	ctxRefl := reflect.TypeOf(ctx)
-
-	recvChan := make(chan interface{}, 100)
-	events.EventsFlow <- &events.ControlEvent{EvType: events.EVENT_USER_CONNECTED, Info: userInfo, Listener: recvChan}
-	defer func() {
-		events.EventsFlow <- &events.ControlEvent{EvType: events.EVENT_USER_DISCONNECTED, Info: userInfo, Listener: recvChan}
-	}()
-
-	go func() {
-		defer func() {
-			log.Println("User ", userInfo.Name, " disconnected")
-			ws.Close()
-			recvChan <- nil
-		}()
-
-		for {
-			reqType, err := rd.ReadString(' ')
-			if err != nil {
-				log.Println("Could not read request type from client: ", err.Error())
-				return
-			}
-
-			reqType = reqType[:len(reqType)-1]
-
-			seqIdStr, err := rd.ReadString('\n')
-			if err != nil {
-				log.Println("Could not read seq id string: ", err.Error())
-				return
-			}
-
-			seqId, err := strconv.Atoi(seqIdStr[:len(seqIdStr)-1])
-			if err != nil {
-				log.Println("Sequence id is not int: ", err.Error())
-				return
-			}
+	if userInfo = authenticateRequest(ws.Request()); userInfo == nil {
+		if versionParam != "" {
+			websocket.JSON.Send(ws, protocol.NewReplyError(0, protocol.ERROR_UNAUTHENTICATED, "AUTH_ERROR"))
+		} else {
+			ws.Write([]byte("AUTH_ERROR"))
+		}
+		return
+	}
 
-			reqCamel := convertUnderscoreToCamelCase(strings.TrimPrefix(reqType, "REQUEST_"))
-			method, ok := ctxRefl.MethodByName("Process" + reqCamel)
-			if !ok {
-				sendError(seqId, recvChan, "Invalid request type: "+reqType)
-				var msg interface{}
-				decoder.Decode(&msg)
-				continue
-			}
+	ip := clientIP(ws.Request())
 
-			start := time.Now()
-			reflMethodType := method.Type.In(1)
+	emailVerified, err := db.IsEmailVerified(ws.Request().Context(), userInfo.Id)
+	if err != nil {
+		log.Println("Could not get email verification status: ", err.Error())
+	}
 
-			userReq := reflect.New(reflMethodType.Elem()).Interface()
+	conn := newWsConnection(ws, userInfo, versionParam, adapter)
+	conn.ip = ip
+	conn.emailVerified = emailVerified
 
-			if err := decoder.Decode(&userReq); err != nil {
-				sendError(seqId, recvChan, "Cannot decode request: "+err.Error())
-				continue
-			}
+	if versionParam != "" {
+		hello := handlers.NewHelloReply(version)
+		hello.Type = "EVENT_HELLO"
+		conn.recvChan <- hello
+	}
 
-			ctx = &handlers.WebsocketCtx{
-				SeqId:    seqId,
-				UserId:   userInfo.Id,
-				Listener: recvChan,
-				UserName: userInfo.Name,
-			}
+	// Invalid id is the same as no id: client will just miss some events
+	lastEventId, _ := strconv.ParseUint(ws.Request().URL.Query().Get("last_event_id"), 10, 64)
 
-			resp := func() (resp interface{}) {
-				defer func() {
-					if r := recover(); r != nil {
-						resp = &protocol.ResponseError{UserMsg: "Internal error", Err: fmt.Errorf("Panic on request: %s %v", reqCamel, r)}
-					}
-				}()
-
-				respSlice := method.Func.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(userReq)})
-				resp = respSlice[0].Interface()
-				return
-			}()
-
-			log.Printf("Processed %s, %+v in %s", reqType, userReq, time.Since(start))
-
-			switch v := resp.(type) {
-			case *protocol.ResponseError:
-				if v.Err != nil {
-					log.Println(reqCamel, ":", v.Err.Error())
-				}
-				sendError(seqId, recvChan, v.UserMsg)
-			case protocol.Reply:
-				v.SetSeqId(seqId)
-				v.SetReplyType(convertCamelCaseToUnderscore(strings.SplitN(fmt.Sprintf("%T", v), ".", 2)[1]))
-				events.EventsFlow <- &events.ControlEvent{
-					EvType:   events.EVENT_USER_REPLY,
-					Listener: recvChan,
-					Reply:    v,
-				}
-			default:
-				log.Panicf("Got %T that does not satisfy protocol.Reply", v)
-			}
-		}
+	events.EventsFlow <- &events.ControlEvent{EvType: events.EVENT_USER_CONNECTED, Info: userInfo, Listener: conn.recvChan, LastEventId: lastEventId}
+	defer func() {
+		events.EventsFlow <- &events.ControlEvent{EvType: events.EVENT_USER_DISCONNECTED, Info: userInfo, Listener: conn.recvChan}
 	}()
 
-	for ev := range recvChan {
-		if ev == nil {
-			return
-		}
+	go conn.readLoop()
+	conn.writeLoop()
+}
 
-		if err := websocket.JSON.Send(ws, ev); err != nil {
-			fmt.Println("Could not send JSON: " + err.Error())
-			return
-		}
+type registerForm struct {
+	Name      string
+	Email     string
+	Error     string
+	CSRFToken string
+}
+
+func serveRegisterPage(form *registerForm, w http.ResponseWriter, req *http.Request) {
+	form.CSRFToken = csrfToken(w, req)
+	if err := registerTpl.Execute(w, form); err != nil {
+		log.Println("Could not render template: " + err.Error())
 	}
 }
 
 func RegisterHandler(w http.ResponseWriter, req *http.Request) {
-	serveStatic("static/register.html", w)
+	serveRegisterPage(&registerForm{}, w, req)
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
 }
 
 func registerUser(email, userPassword, name string) (err error, duplicate bool) {
-	_, err = db.RegisterStmt.Exec(email, passwordHash(userPassword), name)
+	hash, err := password.Hash(userPassword)
 	if err != nil {
-		// TODO: check for duplicate key in Cockroach
+		log.Println("Could not hash password: ", err.Error())
+		return
+	}
+
+	_, err = db.RegisterStmt.Exec(email, hash, name)
+	if isUniqueViolation(err) {
+		return nil, true
+	} else if err != nil {
 		log.Println("Could not register user: ", err.Error())
 	}
 
@@ -386,34 +509,72 @@ func CheckHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func DoRegisterHandler(w http.ResponseWriter, req *http.Request) {
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
 	req.ParseForm()
 
-	name := req.Form.Get("name")
-	email := req.Form.Get("email")
+	form := &registerForm{
+		Name:  req.Form.Get("name"),
+		Email: req.Form.Get("email"),
+	}
 	userPassword := req.Form.Get("password")
 	userPassword2 := req.Form.Get("password2")
 
-	if name == "" || email == "" || userPassword == "" || userPassword2 == "" {
-		fmt.Fprintf(w, "You must provide values for all the fields")
+	name, nameErr := validate.Name(form.Name)
+	email, emailErr := validate.Email(form.Email)
+
+	if form.Name == "" || form.Email == "" || userPassword == "" || userPassword2 == "" {
+		form.Error = "You must provide values for all the fields"
+	} else if nameErr != nil {
+		form.Error = nameErr.Error()
+	} else if emailErr != nil {
+		form.Error = emailErr.Error()
+	} else if userPassword != userPassword2 {
+		form.Error = "Passwords do not match"
+	} else if err := validate.Password(userPassword, name, email); err != nil {
+		form.Error = err.Error()
+	}
+
+	if form.Error != "" {
+		serveRegisterPage(form, w, req)
 		return
 	}
 
-	if userPassword != userPassword2 {
-		fmt.Fprintf(w, "Passwords do not match")
+	// Every registration counts as a failure so that one address cannot create lots of users
+	ip := clientIP(req)
+	if err := checkThrottles(map[*session.Throttle]string{registerIPThrottle: ip}); err != nil {
+		form.Error = err.Error()
+		serveRegisterPage(form, w, req)
 		return
 	}
 
+	if lockout, err := registerIPThrottle.Fail(ip); err != nil {
+		log.Println("Could not record registration attempt: ", err.Error())
+	} else if lockout > 0 {
+		log.Printf("Registration from %s is locked out for %s", ip, lockout)
+	}
+
 	err, dup := registerUser(email, userPassword, name)
 	if err != nil {
-		fmt.Fprintf(w, "Sorry, internal error occured while trying to register your user")
+		form.Error = "Sorry, internal error occured while trying to register your user"
+		serveRegisterPage(form, w, req)
+		return
 	} else if dup {
-		fmt.Fprintf(w, "Sorry, user already exists")
-	} else {
-		w.Header().Add("Content-type", "text/html; charset=UTF-8")
-		fmt.Fprintf(w, "Success! <a href='/'>Go to login page</a>")
+		form.Error = "Sorry, user with this email already exists"
+		serveRegisterPage(form, w, req)
+		return
 	}
 
-	return
+	if err := sendVerificationLink(email); err != nil {
+		log.Println("Could not send verification link: ", err.Error())
+	}
+
+	w.Header().Add("Content-type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "Success! We have sent you an email to confirm your address. <a href='/'>Go to login page</a>")
 }
 
 func listen(addr string) {
@@ -471,18 +632,36 @@ func main() {
 
 	session.InitSession()
 
+	log.Println("Initializing mailer")
+
+	mailer.InitMailer()
+	handlers.InitRateLimits()
+
 	log.Println("Registering handlers")
 
-	http.Handle("/events", websocket.Handler(WebsocketEventsHandler))
+	// Recovery is the innermost, so that logging and timing see panics as internal errors
+	// Scope is checked before rate limit, so that requests the token cannot make do not use up the limit
+	handlers.Use(handlers.LoggingInterceptor, handlers.TimingInterceptor, handlers.ScopeInterceptor, handlers.RateLimitInterceptor, handlers.RecoveryInterceptor)
+
+	http.Handle("/events", websocket.Server{Handler: WebsocketEventsHandler, Handshake: websocketHandshake})
 	go events.EventsDispatcher()
+	go accountDeletionThread()
 
 	http.HandleFunc("/avatars/", AvatarServer)
 	http.HandleFunc("/static/", StaticServer)
 	http.HandleFunc("/check", CheckHandler)
 	http.HandleFunc("/login", LoginHandler)
+	http.HandleFunc("/login-totp", LoginTotpHandler)
 	http.HandleFunc("/logout", LogoutHandler)
 	http.HandleFunc("/register", RegisterHandler)
 	http.HandleFunc("/do-register", DoRegisterHandler)
+	http.HandleFunc("/forgot-password", ForgotPasswordHandler)
+	http.HandleFunc("/reset-password", ResetPasswordHandler)
+	http.HandleFunc("/verify-email", VerifyEmailHandler)
+	http.HandleFunc("/resend-verification", ResendVerificationHandler)
+	http.HandleFunc("/export", ExportHandler)
+	http.HandleFunc(apiPrefix, APIHandler)
+	http.HandleFunc("/protocol.json", ProtocolSchemaHandler)
 	http.HandleFunc("/", IndexHandler)
 
 	go listen(config.Conf.Bind)
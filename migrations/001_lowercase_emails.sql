@@ -0,0 +1,11 @@
+-- Emails are stored lowercased since registration started to normalize them,
+-- this brings older users to the same form so that login can look them up by one value.
+--
+-- Accounts that differ only in case of email cannot be merged automatically and make
+-- the update fail, resolve them first. They can be found with:
+--
+--   SELECT lower(trim(email)), array_agg(id) FROM socialuser GROUP BY 1 HAVING count(*) > 1;
+
+UPDATE socialuser SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+
+CREATE UNIQUE INDEX socialuser_lower_email_key ON socialuser ((lower(email)));
@@ -0,0 +1,8 @@
+-- Sessions, tokens and throttles can be kept in the database with SessionStore = "sql"
+
+CREATE TABLE IF NOT EXISTS kvstore (
+  k VARCHAR(255) PRIMARY KEY,
+  v BYTES,
+  expires BIGINT,
+  INDEX(expires)
+);
@@ -0,0 +1,4 @@
+-- Users that registered before email verification are treated as verified,
+-- new users get false from RegisterStmt
+
+ALTER TABLE socialuser ADD COLUMN IF NOT EXISTS email_verified BOOL DEFAULT true;
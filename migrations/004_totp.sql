@@ -0,0 +1,13 @@
+-- Two-factor authentication is off for everyone until they enroll.
+-- totp_last_step is the time step of the last accepted code, so that it cannot be used again.
+
+ALTER TABLE socialuser ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) DEFAULT '';
+ALTER TABLE socialuser ADD COLUMN IF NOT EXISTS totp_enabled BOOL DEFAULT false;
+ALTER TABLE socialuser ADD COLUMN IF NOT EXISTS totp_last_step BIGINT DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recoverycode (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  code_hash VARCHAR(64),
+  INDEX(user_id, code_hash)
+);
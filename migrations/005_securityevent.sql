@@ -0,0 +1,10 @@
+-- Security events such as login lockouts that users can see in their account
+
+CREATE TABLE IF NOT EXISTS securityevent (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  event_type VARCHAR(64),
+  ip VARCHAR(64),
+  ts BIGINT,
+  INDEX(user_id, ts)
+);
@@ -0,0 +1,13 @@
+-- API tokens, only sha256 of the token is stored
+
+CREATE TABLE IF NOT EXISTS apitoken (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  name VARCHAR(255),
+  token_hash VARCHAR(64),
+  scopes VARCHAR(1024),
+  created_ts BIGINT,
+  last_used_ts BIGINT,
+  UNIQUE (token_hash),
+  INDEX(user_id)
+);
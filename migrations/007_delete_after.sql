@@ -0,0 +1,3 @@
+-- Zero means that account deletion is not scheduled
+
+ALTER TABLE socialuser ADD COLUMN IF NOT EXISTS delete_after BIGINT DEFAULT 0;
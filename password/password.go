@@ -0,0 +1,85 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes are stored in socialuser.password and the format tells us which scheme was used:
+//
+//	sha1hex:md5hex        legacy unsalted hash, only verified and never produced
+//	$2a$<cost>$<...>      bcrypt with a per-user salt embedded into the hash
+const legacySeparator = ":"
+
+func cost() int {
+	if config.Conf.PasswordCost == 0 {
+		return bcrypt.DefaultCost
+	}
+
+	return config.Conf.PasswordCost
+}
+
+func legacyHash(password string) string {
+	sh := sha1.New()
+	io.WriteString(sh, password)
+
+	md := md5.New()
+	io.WriteString(md, password)
+
+	return fmt.Sprintf("%x:%x", sh.Sum(nil), md.Sum(nil))
+}
+
+func isLegacy(hash string) bool {
+	return strings.Contains(hash, legacySeparator)
+}
+
+// Hash returns hash of the password in the current format
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost())
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// DummyHash returns a hash in the current format that no one uses. Checking a password
+// against it takes as long as against a real hash, so it is used when there is no such user
+// to not reveal that through response time.
+func DummyHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = Hash("not a real password")
+	})
+
+	return dummyHash
+}
+
+// Verify checks password against the stored hash. When the password matches but the hash
+// is stored in an outdated format (or with an outdated cost), needsRehash is set so that
+// the caller can replace it with the result of Hash().
+func Verify(password, hash string) (ok, needsRehash bool) {
+	if isLegacy(hash) {
+		ok = subtle.ConstantTimeCompare([]byte(legacyHash(password)), []byte(hash)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, false
+	}
+
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || hashCost != cost()
+}
@@ -0,0 +1,41 @@
+package password
+
+import "testing"
+
+func TestVerify(t *testing.T) {
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatalf("Could not hash password: %s", err.Error())
+	}
+
+	if ok, needsRehash := Verify("secret", hash); !ok || needsRehash {
+		t.Fatalf("Unexpected result for fresh hash: ok=%v, needsRehash=%v", ok, needsRehash)
+	}
+
+	if ok, _ := Verify("wrong", hash); ok {
+		t.Fatalf("Wrong password must not match")
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	hash := legacyHash("secret")
+
+	if ok, needsRehash := Verify("secret", hash); !ok || !needsRehash {
+		t.Fatalf("Unexpected result for legacy hash: ok=%v, needsRehash=%v", ok, needsRehash)
+	}
+
+	if ok, needsRehash := Verify("wrong", hash); ok || needsRehash {
+		t.Fatalf("Unexpected result for wrong password: ok=%v, needsRehash=%v", ok, needsRehash)
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	hash := DummyHash()
+	if isLegacy(hash) || hash != DummyHash() {
+		t.Fatalf("Dummy hash must be a bcrypt hash that is computed once: %q", hash)
+	}
+
+	if ok, _ := Verify("secret", hash); ok {
+		t.Fatalf("Dummy hash must not match")
+	}
+}
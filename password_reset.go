@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+	"github.com/YuriyNasretdinov/social-net/db"
+	"github.com/YuriyNasretdinov/social-net/events"
+	"github.com/YuriyNasretdinov/social-net/mailer"
+	"github.com/YuriyNasretdinov/social-net/password"
+	"github.com/YuriyNasretdinov/social-net/session"
+	"github.com/YuriyNasretdinov/social-net/validate"
+)
+
+const (
+	resetTokenKind = "reset"
+	resetTokenTTL  = time.Hour
+)
+
+// Links in emails must not depend on Host header of the request that triggered them,
+// otherwise anyone could get a reset link pointing to their own site sent to a user.
+func siteURL() string {
+	if config.Conf.CertDir != "" {
+		return "https://" + config.Conf.Host
+	}
+
+	return "http://" + config.Conf.Host
+}
+
+func ForgotPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		serveFormPage(forgotPasswordTpl, w, req)
+		return
+	}
+
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	req.ParseForm()
+	email := req.Form.Get("email")
+
+	if email == "" {
+		fmt.Fprintf(w, "You must provide email")
+		return
+	}
+
+	if err := sendResetLink(email); err != nil {
+		log.Println("Could not send password reset link: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to send you an email")
+		return
+	}
+
+	// The same answer for registered and unknown emails so that it cannot be used to check registrations
+	w.Header().Add("Content-type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "If this email is registered, we have sent instructions to it. <a href='/'>Go to login page</a>")
+}
+
+func sendResetLink(email string) error {
+	info, err := getLoginInfo(email)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := session.CreateToken(resetTokenKind, []byte(fmt.Sprint(info.Id)), resetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(email, "Password reset", fmt.Sprintf(
+		"Hello, %s!\n\nTo set a new password follow the link below within %s:\n\n%s/reset-password?token=%s\n\n"+
+			"If you did not ask for a password reset, just ignore this email.",
+		info.Name, resetTokenTTL, siteURL(), token,
+	))
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	token := req.Form.Get("token")
+
+	if req.Method != http.MethodPost {
+		data := struct{ Token, CSRFToken string }{token, csrfToken(w, req)}
+		if err := resetPasswordTpl.Execute(w, data); err != nil {
+			log.Println("Could not render template: " + err.Error())
+		}
+		return
+	}
+
+	if err := checkCSRF(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	userPassword := req.Form.Get("password")
+	userPassword2 := req.Form.Get("password2")
+
+	if token == "" || userPassword == "" || userPassword2 == "" {
+		fmt.Fprintf(w, "You must provide values for all the fields")
+		return
+	}
+
+	if userPassword != userPassword2 {
+		fmt.Fprintf(w, "Passwords do not match")
+		return
+	}
+
+	if err := validate.Password(userPassword); err != nil {
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	value, err := session.ConsumeToken(resetTokenKind, token)
+	if err == session.ErrNotFound {
+		fmt.Fprintf(w, "The link is invalid or has expired, please request a new one")
+		return
+	} else if err != nil {
+		log.Println("Could not get password reset token: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to reset your password")
+		return
+	}
+
+	userId, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		log.Println("Invalid password reset token value: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to reset your password")
+		return
+	}
+
+	if err = resetPassword(userId, userPassword); err != nil {
+		log.Println("Could not reset password: ", err.Error())
+		fmt.Fprintf(w, "Sorry, internal error occured while trying to reset your password")
+		return
+	}
+
+	w.Header().Add("Content-type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "Your password has been changed! <a href='/'>Go to login page</a>")
+}
+
+func resetPassword(userId uint64, userPassword string) error {
+	hash, err := password.Hash(userPassword)
+	if err != nil {
+		return err
+	}
+
+	if _, err = db.UpdatePasswordStmt.Exec(hash, userId); err != nil {
+		return err
+	}
+
+	if err = session.DeleteUserSessions(userId, ""); err != nil {
+		return err
+	}
+
+	events.EventsFlow <- &events.ControlEvent{
+		EvType: events.EVENT_SESSION_REVOKED,
+		Info:   &events.InternalEventSessionRevoked{UserId: userId},
+	}
+
+	return nil
+}
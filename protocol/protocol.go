@@ -1,5 +1,7 @@
 package protocol
 
+import "encoding/json"
+
 const (
 	REQUEST_GET_MESSAGES = iota
 	REQUEST_SEND_MESSAGE
@@ -13,6 +15,25 @@ const (
 	REQUEST_GET_PROFILE
 	REQUEST_UPDATE_PROFILE
 	REQUEST_GET_TIMELINE_FOR_HASH
+	REQUEST_GET_SESSIONS
+	REQUEST_REVOKE_SESSION
+	REQUEST_ENROLL_TOTP
+	REQUEST_CONFIRM_TOTP
+	REQUEST_DISABLE_TOTP
+	REQUEST_GET_SECURITY_EVENTS
+	REQUEST_CREATE_API_TOKEN
+	REQUEST_GET_API_TOKENS
+	REQUEST_REVOKE_API_TOKEN
+	REQUEST_DELETE_ACCOUNT
+	REQUEST_CANCEL_DELETE_ACCOUNT
+	REQUEST_EXPORT_DATA
+	REQUEST_CHANGE_PASSWORD
+	REQUEST_CHANGE_EMAIL
+	REQUEST_DESCRIBE
+	REQUEST_HELLO
+	REQUEST_BATCH
+	REQUEST_CANCEL
+	REQUEST_PONG
 
 	REPLY_ERROR = iota
 	REPLY_MESSAGES_LIST
@@ -21,11 +42,51 @@ const (
 	REPLY_GET_MESSAGES_USERS
 	REPLY_GET_FRIENDS
 	REPLY_GET_PROFILE
-
-	MAX_MESSAGES_LIMIT   = 100
-	MAX_TIMELINE_LIMIT   = 100
-	MAX_USERS_LIST_LIMIT = 100
-	MAX_FRIENDS_LIMIT    = 100
+	REPLY_GET_SESSIONS
+	REPLY_ENROLL_TOTP
+	REPLY_CONFIRM_TOTP
+	REPLY_GET_SECURITY_EVENTS
+	REPLY_CREATE_API_TOKEN
+	REPLY_GET_API_TOKENS
+	REPLY_DELETE_ACCOUNT
+	REPLY_EXPORT_DATA
+	REPLY_DESCRIBE
+	REPLY_HELLO
+	REPLY_BATCH
+
+	// Version of the structs in this package, see handlers.ProtocolAdapter
+	PROTOCOL_VERSION = 1
+	// Clients that do not announce protocol version were written for this one
+	DEFAULT_PROTOCOL_VERSION = 1
+
+	MAX_MESSAGES_LIMIT        = 100
+	MAX_TIMELINE_LIMIT        = 100
+	MAX_USERS_LIST_LIMIT      = 100
+	MAX_FRIENDS_LIMIT         = 100
+	MAX_SECURITY_EVENTS_LIMIT = 100
+	MAX_BATCH_SIZE            = 20
+
+	SECURITY_EVENT_LOGIN_LOCKOUT          = "LOGIN_LOCKOUT"
+	SECURITY_EVENT_DELETION_REQUESTED     = "DELETION_REQUESTED"
+	SECURITY_EVENT_DELETION_CANCELLED     = "DELETION_CANCELLED"
+	SECURITY_EVENT_PASSWORD_CHANGED       = "PASSWORD_CHANGED"
+	SECURITY_EVENT_EMAIL_CHANGE_REQUESTED = "EMAIL_CHANGE_REQUESTED"
+
+	// Codes of REPLY_ERROR, unlike messages they never change, so clients can rely on them
+	ERROR_INVALID_ARGUMENT    = "INVALID_ARGUMENT"
+	ERROR_NOT_FOUND           = "NOT_FOUND"
+	ERROR_ALREADY_EXISTS      = "ALREADY_EXISTS"
+	ERROR_UNAUTHENTICATED     = "UNAUTHENTICATED"
+	ERROR_PERMISSION_DENIED   = "PERMISSION_DENIED"
+	ERROR_FAILED_PRECONDITION = "FAILED_PRECONDITION"
+	ERROR_RATE_LIMITED        = "RATE_LIMITED"
+	ERROR_CANCELLED           = "CANCELLED"
+	ERROR_DEADLINE_EXCEEDED   = "DEADLINE_EXCEEDED"
+	ERROR_INTERNAL            = "INTERNAL"
+
+	// API token scopes, besides these a scope can be a request type, e.g. REQUEST_SEND_MESSAGE
+	SCOPE_ALL  = "all"
+	SCOPE_READ = "read"
 
 	MSG_TYPE_OUT = true
 	MSG_TYPE_IN  = false
@@ -83,10 +144,38 @@ type (
 		Ts       string
 	}
 
+	JSSessionInfo struct {
+		Id         string
+		CreatedTs  string
+		LastSeenTs string
+		IP         string
+		UserAgent  string
+		Current    bool
+	}
+
+	JSSecurityEvent struct {
+		Type string
+		IP   string
+		Ts   string
+	}
+
+	JSApiToken struct {
+		Id         string
+		Name       string
+		Scopes     []string
+		CreatedTs  string
+		LastUsedTs string
+	}
+
 	ResponseError struct {
 		BaseReply
+		Code    string
 		UserMsg string
-		Err     error
+		// Request field => what is wrong with it
+		Details map[string]string
+		// Retryable is only needed for errors that are retryable although their code usually is not
+		Retryable bool
+		Err       error
 	}
 
 	RequestGetMessages struct {
@@ -148,6 +237,80 @@ type (
 		CityName       string
 		FamilyPosition int
 	}
+
+	RequestGetSessions struct {
+	}
+
+	RequestRevokeSession struct {
+		Id string
+	}
+
+	RequestEnrollTotp struct {
+	}
+
+	RequestConfirmTotp struct {
+		Code string
+	}
+
+	// Code is either TOTP code or one of recovery codes
+	RequestDisableTotp struct {
+		Code string
+	}
+
+	RequestGetSecurityEvents struct {
+		Limit uint64
+	}
+
+	RequestCreateApiToken struct {
+		Name   string
+		Scopes []string
+	}
+
+	RequestGetApiTokens struct {
+	}
+
+	RequestRevokeApiToken struct {
+		Id string
+	}
+
+	RequestDeleteAccount struct {
+		Password string
+	}
+
+	RequestCancelDeleteAccount struct {
+	}
+
+	RequestExportData struct {
+	}
+
+	RequestChangePassword struct {
+		OldPassword string
+		NewPassword string
+	}
+
+	RequestChangeEmail struct {
+		Password string
+		NewEmail string
+	}
+
+	RequestDescribe struct {
+	}
+
+	BatchItem struct {
+		Type  string
+		SeqId int
+		Data  json.RawMessage
+	}
+
+	// Requests are processed one by one in the given order
+	RequestBatch struct {
+		Requests []BatchItem
+	}
+
+	// Must be the first frame on websocket unless version is passed as "version" query parameter
+	RequestHello struct {
+		Version int
+	}
 )
 
 // Reply types
@@ -192,17 +355,118 @@ type (
 		RequestAccepted bool
 	}
 
+	ReplyGetSessions struct {
+		BaseReply
+		Sessions []JSSessionInfo
+	}
+
+	ReplyEnrollTotp struct {
+		BaseReply
+		Secret string
+		Uri    string
+	}
+
+	ReplyConfirmTotp struct {
+		BaseReply
+		RecoveryCodes []string
+	}
+
+	ReplyGetSecurityEvents struct {
+		BaseReply
+		Events []JSSecurityEvent
+	}
+
+	// Token is only shown once, afterwards only its hash is kept
+	ReplyCreateApiToken struct {
+		BaseReply
+		Id    string
+		Token string
+	}
+
+	ReplyGetApiTokens struct {
+		BaseReply
+		Tokens []JSApiToken
+	}
+
+	// Account is deleted after the grace period unless deletion is cancelled
+	ReplyDeleteAccount struct {
+		BaseReply
+		DeleteAfterTs string
+	}
+
+	ReplyExportData struct {
+		BaseReply
+		Url       string
+		ExpiresTs string
+	}
+
+	// Schema is JSON Schema of the whole protocol, the same as served at /protocol.json
+	ReplyDescribe struct {
+		BaseReply
+		Schema json.RawMessage
+	}
+
+	// Reply to REQUEST_HELLO, also sent as EVENT_HELLO when version is passed in the query string
+	ReplyHello struct {
+		BaseReply
+		Version           int
+		SupportedVersions []int
+		Capabilities      []string
+	}
+
+	// One reply per request in the same order, failed requests get REPLY_ERROR with SeqId of the item
+	ReplyBatch struct {
+		BaseReply
+		Replies []Reply
+	}
+
 	ReplyGeneric struct {
 		BaseReply
 		Success bool
 	}
 
+	// Message is for humans and Code is for programs. Retryable means that the same request
+	// can succeed later, e.g. after the database is back or the rate limit is reset.
 	ReplyError struct {
 		BaseReply
-		Message string
+		Code      string
+		Message   string
+		Details   map[string]string `json:",omitempty"`
+		Retryable bool
 	}
 )
 
+var retryableErrors = map[string]bool{
+	ERROR_RATE_LIMITED:      true,
+	ERROR_DEADLINE_EXCEEDED: true,
+	ERROR_INTERNAL:          true,
+}
+
+func NewReplyError(seqId int, code, message string) *ReplyError {
+	reply := new(ReplyError)
+	reply.SeqId = seqId
+	reply.Type = "REPLY_ERROR"
+	reply.Code = code
+	reply.Message = message
+	reply.Retryable = retryableErrors[code]
+
+	return reply
+}
+
+// ToReply converts error returned by a handler into what is sent to the client
+func (e *ResponseError) ToReply(seqId int) *ReplyError {
+	code := e.Code
+	if code == "" {
+		code = ERROR_INTERNAL
+	}
+
+	reply := NewReplyError(seqId, code, e.UserMsg)
+	reply.Details = e.Details
+	reply.Retryable = reply.Retryable || e.Retryable
+
+	return reply
+}
+
 func (p *BaseReply) SetSeqId(id int) {
 	p.SeqId = id
 }
@@ -0,0 +1,108 @@
+// Package ratelimit implements token buckets for limiting how often clients can make requests
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Keyed buckets that were not used for this long are full anyway, so they are forgotten
+const sweepInterval = time.Minute
+
+type (
+	// Bucket holds up to Burst tokens and gets Rate tokens per second. Zero value is not usable, use NewBucket.
+	Bucket struct {
+		rate  float64
+		burst float64
+
+		mu     sync.Mutex
+		tokens float64
+		last   time.Time
+	}
+
+	// Buckets keeps a separate bucket for every key, e.g. user id
+	Buckets struct {
+		rate  float64
+		burst float64
+
+		mu        sync.Mutex
+		buckets   map[uint64]*Bucket
+		lastSweep time.Time
+	}
+)
+
+// NewBucket returns a full bucket
+func NewBucket(rate, burst float64) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	b.last = now
+}
+
+// Take removes n tokens if the bucket has that many and reports whether it did
+func (b *Bucket) Take(n float64) bool {
+	return b.take(n, time.Now())
+}
+
+func (b *Bucket) take(n float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// NewBuckets returns buckets that are created full for every new key
+func NewBuckets(rate, burst float64) *Buckets {
+	return &Buckets{rate: rate, burst: burst, buckets: make(map[uint64]*Bucket), lastSweep: time.Now()}
+}
+
+// Take removes n tokens from the bucket for the key if it has that many and reports whether it did
+func (b *Buckets) Take(key uint64, n float64) bool {
+	return b.take(key, n, time.Now())
+}
+
+func (b *Buckets) take(key uint64, n float64, now time.Time) bool {
+	b.mu.Lock()
+
+	if now.Sub(b.lastSweep) > sweepInterval {
+		for k, bucket := range b.buckets {
+			if bucket.full(now) {
+				delete(b.buckets, k)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &Bucket{rate: b.rate, burst: b.burst, tokens: b.burst, last: now}
+		b.buckets[key] = bucket
+	}
+
+	b.mu.Unlock()
+
+	return bucket.take(n, now)
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &Bucket{rate: 2, burst: 4, tokens: 4, last: now}
+
+	if !b.take(3, now) {
+		t.Fatalf("Full bucket must allow taking less than burst")
+	}
+
+	if b.take(2, now) {
+		t.Fatalf("Bucket must not allow taking more than it has")
+	}
+
+	if !b.take(2, now.Add(500*time.Millisecond)) {
+		t.Fatalf("Bucket must be refilled with time")
+	}
+
+	if !b.take(1, now.Add(time.Second)) || b.tokens != 0 {
+		t.Fatalf("Unexpected tokens count: %v", b.tokens)
+	}
+
+	if !b.full(now.Add(time.Hour)) || b.tokens != b.burst {
+		t.Fatalf("Bucket must not be filled above burst: %v", b.tokens)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	now := time.Now()
+	b := NewBuckets(1, 2)
+
+	if !b.take(1, 2, now) || b.take(1, 1, now) {
+		t.Fatalf("Bucket for key 1 must be empty")
+	}
+
+	if !b.take(2, 2, now) {
+		t.Fatalf("Buckets for different keys must be independent")
+	}
+
+	b.take(3, 0, now.Add(sweepInterval+time.Hour))
+	if len(b.buckets) != 1 {
+		t.Fatalf("Full buckets must be forgotten, left: %d", len(b.buckets))
+	}
+}
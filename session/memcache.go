@@ -0,0 +1,90 @@
+package session
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Memcache treats expiration values larger than 30 days as unix timestamps
+const memcacheMaxRelativeExpiration = 30 * 24 * time.Hour
+
+type memcacheStore struct {
+	mc *memcache.Client
+}
+
+func newMemcacheStore(server string) *memcacheStore {
+	return &memcacheStore{mc: memcache.New(server)}
+}
+
+func memcacheExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	} else if ttl > memcacheMaxRelativeExpiration {
+		return int32(expiresAt(ttl).Unix())
+	}
+
+	return int32(ttl / time.Second)
+}
+
+func (s *memcacheStore) Get(key string) ([]byte, error) {
+	item, err := s.mc.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.Value, nil
+}
+
+func (s *memcacheStore) Set(key string, value []byte, ttl time.Duration) error {
+	return s.mc.Set(&memcache.Item{Key: key, Value: value, Expiration: memcacheExpiration(ttl)})
+}
+
+// Memcache has no get-and-delete, but only one of concurrent deletes of the same key succeeds
+func (s *memcacheStore) Take(key string) ([]byte, error) {
+	item, err := s.mc.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = s.mc.Delete(key); err == memcache.ErrCacheMiss {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.Value, nil
+}
+
+// Increment does not create missing keys and Add fails when the key already exists,
+// so one of them succeeds no matter how many clients race for the same key
+func (s *memcacheStore) Incr(key string, ttl time.Duration) (int64, error) {
+	for {
+		n, err := s.mc.Increment(key, 1)
+		if err == nil {
+			return int64(n), s.mc.Touch(key, memcacheExpiration(ttl))
+		} else if err != memcache.ErrCacheMiss {
+			return 0, err
+		}
+
+		err = s.mc.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: memcacheExpiration(ttl)})
+		if err == nil {
+			return 1, nil
+		} else if err != memcache.ErrNotStored {
+			return 0, err
+		}
+	}
+}
+
+func (s *memcacheStore) Delete(key string) error {
+	err := s.mc.Delete(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const memoryCleanupInterval = time.Minute
+
+type (
+	memoryItem struct {
+		value   []byte
+		expires time.Time
+	}
+
+	// memoryStore keeps sessions in process memory, so they are lost on restart.
+	// It is meant for tests and single-box deployments without memcache.
+	memoryStore struct {
+		mu    sync.Mutex
+		items map[string]memoryItem
+	}
+)
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{items: make(map[string]memoryItem)}
+	go s.cleanupThread()
+	return s
+}
+
+func (it memoryItem) expired(now time.Time) bool {
+	return !it.expires.IsZero() && now.After(it.expires)
+}
+
+func (s *memoryStore) cleanupThread() {
+	for range time.Tick(memoryCleanupInterval) {
+		now := time.Now()
+
+		s.mu.Lock()
+		for key, it := range s.items {
+			if it.expired(now) {
+				delete(s.items, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[key]
+	if !ok || it.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return it.value, nil
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[key] = memoryItem{value: value, expires: expiresAt(ttl)}
+	return nil
+}
+
+func (s *memoryStore) Take(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[key]
+	if !ok || it.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	delete(s.items, key)
+	return it.value, nil
+}
+
+func (s *memoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	if it, ok := s.items[key]; ok && !it.expired(time.Now()) {
+		n, _ = strconv.ParseInt(string(it.value), 10, 64)
+	}
+
+	n++
+	s.items[key] = memoryItem{value: []byte(strconv.FormatInt(n, 10)), expires: expiresAt(ttl)}
+	return n, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
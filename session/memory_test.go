@@ -0,0 +1,40 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := &memoryStore{items: make(map[string]memoryItem)}
+
+	if _, err := s.Get("missing"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for missing key, got %v", err)
+	}
+
+	s.Set("forever", []byte("value"), 0)
+	s.Set("expired", []byte("value"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if v, err := s.Get("forever"); err != nil || string(v) != "value" {
+		t.Fatalf("Unexpected result for key without ttl: %q, %v", v, err)
+	}
+
+	if _, err := s.Get("expired"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for expired key, got %v", err)
+	}
+
+	s.Set("once", []byte("value"), 0)
+	if v, err := s.Take("once"); err != nil || string(v) != "value" {
+		t.Fatalf("Unexpected result of Take: %q, %v", v, err)
+	}
+
+	if _, err := s.Take("once"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for key that was already taken, got %v", err)
+	}
+
+	s.Delete("forever")
+	if _, err := s.Get("forever"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+}
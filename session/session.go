@@ -1,37 +1,111 @@
 package session
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/YuriyNasretdinov/social-net/config"
-	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/YuriyNasretdinov/social-net/db"
+)
+
+const (
+	STORE_MEMCACHE = "memcache"
+	STORE_MEMORY   = "memory"
+	STORE_SQL      = "sql"
+
+	defaultSessionTTL = 30 * 24 * time.Hour
+
+	sessionIdBytes = 16
+
+	// Sliding expiration is not extended more often than that to avoid writing
+	// to the store on every request
+	touchInterval = time.Minute
 )
 
 type (
 	SessionInfo struct {
-		Id   uint64
-		Name string
+		Id         uint64
+		Name       string
+		SessionId  string `json:"-"`
+		CreatedTs  int64
+		LastSeenTs int64
+		IP         string
+		UserAgent  string
+
+		// Set when user is authenticated with API token instead of session cookie
+		TokenId uint64   `json:"-"`
+		Scopes  []string `json:"-"`
 	}
 )
 
-var mc *memcache.Client
+var (
+	store Store
 
+	// Protects read-modify-write of user sessions index. Concurrent updates from
+	// different processes can still lose an entry, in which case the session
+	// just does not show up in the list until it expires.
+	indexMu sync.Mutex
+)
+
+// InitSession must be called after db.InitStmts() because sql store uses db connection
 func InitSession() {
-	rand.Seed(time.Now().UnixNano())
-	mc = memcache.New(config.Conf.Memcache)
+	initSignKeys()
+
+	switch config.Conf.SessionStore {
+	case "", STORE_MEMCACHE:
+		store = newMemcacheStore(config.Conf.Memcache)
+	case STORE_MEMORY:
+		store = newMemoryStore()
+	case STORE_SQL:
+		store = newSQLStore(db.Db)
+	default:
+		log.Fatal("Unknown session store: " + config.Conf.SessionStore)
+	}
 }
 
-func GetSessionInfo(id string) (result *SessionInfo, err error) {
-	var item *memcache.Item
-	item, err = mc.Get("session_" + id)
+func sessionTTL() time.Duration {
+	if config.Conf.SessionTTL == 0 {
+		return defaultSessionTTL
+	}
+
+	return time.Duration(config.Conf.SessionTTL) * time.Second
+}
+
+func sessionKey(id string) string {
+	return "session_" + id
+}
+
+func userSessionsKey(userId uint64) string {
+	return fmt.Sprintf("user_sessions_%d", userId)
+}
+
+// Handle returns identifier of the session that is safe to show to the user:
+// knowing it is not enough to impersonate the session.
+func Handle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func saveSession(info *SessionInfo) error {
+	contents, err := json.Marshal(info)
 	if err != nil {
-		return
+		return err
 	}
 
-	contents := item.Value
+	return store.Set(sessionKey(info.SessionId), contents, sessionTTL())
+}
+
+func loadSession(id string) (result *SessionInfo, err error) {
+	contents, err := store.Get(sessionKey(id))
+	if err != nil {
+		return
+	}
 
 	result = new(SessionInfo)
 	err = json.Unmarshal(contents, &result)
@@ -39,24 +113,186 @@ func GetSessionInfo(id string) (result *SessionInfo, err error) {
 		return
 	}
 
+	result.SessionId = id
 	return
 }
 
+// GetSessionInfo returns session info and extends session lifetime
+func GetSessionInfo(id string) (result *SessionInfo, err error) {
+	result, err = loadSession(id)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(0, result.LastSeenTs)) < touchInterval {
+		return
+	}
+
+	result.LastSeenTs = now.UnixNano()
+	if err := saveSession(result); err != nil {
+		log.Println("Could not extend session: ", err.Error())
+	}
+
+	return result, nil
+}
+
+func newSessionId() (string, error) {
+	buf := make([]byte, sessionIdBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
 // Create session with info and return session identifier or error
 func CreateSession(info *SessionInfo) (id string, err error) {
-	var contents []byte
-	contents, err = json.Marshal(info)
+	now := time.Now().UnixNano()
+
+	info.SessionId, err = newSessionId()
 	if err != nil {
-		return
+		return "", err
 	}
 
-	id = fmt.Sprint(rand.Int63())
-	err = mc.Set(&memcache.Item{Key: "session_" + id, Value: contents})
+	info.CreatedTs = now
+	info.LastSeenTs = now
 
+	if err = saveSession(info); err != nil {
+		return "", err
+	}
+
+	if err = updateUserSessions(info.Id, func(ids []string) []string { return append(ids, info.SessionId) }); err != nil {
+		return "", err
+	}
+
+	return info.SessionId, nil
+}
+
+// DeleteSession removes session so that it can no longer be used
+func DeleteSession(id string) error {
+	info, err := loadSession(id)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = store.Delete(sessionKey(id)); err != nil {
+		return err
+	}
+
+	return updateUserSessions(info.Id, func(ids []string) []string { return removeId(ids, id) })
+}
+
+// DeleteUserSessions removes all sessions of the user except the given one (if any)
+func DeleteUserSessions(userId uint64, exceptId string) error {
+	ids, err := getUserSessionIds(userId)
 	if err != nil {
-		id = ""
-		return
+		return err
 	}
 
+	for _, id := range ids {
+		if id == exceptId {
+			continue
+		}
+
+		if err = store.Delete(sessionKey(id)); err != nil {
+			return err
+		}
+	}
+
+	return updateUserSessions(userId, func(ids []string) []string {
+		res := ids[:0]
+		for _, id := range ids {
+			if id == exceptId {
+				res = append(res, id)
+			}
+		}
+		return res
+	})
+}
+
+// GetUserSessions returns all active sessions of the user
+func GetUserSessions(userId uint64) ([]*SessionInfo, error) {
+	ids, err := getUserSessionIds(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*SessionInfo, 0, len(ids))
+	expired := make([]string, 0)
+
+	for _, id := range ids {
+		info, err := loadSession(id)
+		if err == ErrNotFound {
+			expired = append(expired, id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		res = append(res, info)
+	}
+
+	if len(expired) > 0 {
+		err = updateUserSessions(userId, func(ids []string) []string {
+			for _, id := range expired {
+				ids = removeId(ids, id)
+			}
+			return ids
+		})
+
+		if err != nil {
+			log.Println("Could not clean up user sessions index: ", err.Error())
+		}
+	}
+
+	return res, nil
+}
+
+func getUserSessionIds(userId uint64) (ids []string, err error) {
+	contents, err := store.Get(userSessionsKey(userId))
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, &ids)
 	return
 }
+
+func updateUserSessions(userId uint64, cb func(ids []string) []string) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	ids, err := getUserSessionIds(userId)
+	if err != nil {
+		return err
+	}
+
+	ids = cb(ids)
+	if len(ids) == 0 {
+		return store.Delete(userSessionsKey(userId))
+	}
+
+	contents, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	// The index does not expire by itself because sessions in it are extended
+	// independently, stale entries are removed in GetUserSessions instead
+	return store.Set(userSessionsKey(userId), contents, 0)
+}
+
+func removeId(ids []string, id string) []string {
+	res := ids[:0]
+	for _, v := range ids {
+		if v != id {
+			res = append(res, v)
+		}
+	}
+	return res
+}
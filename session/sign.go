@@ -0,0 +1,64 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strings"
+
+	"github.com/YuriyNasretdinov/social-net/config"
+)
+
+var signKeys [][]byte
+
+// The first key is used for signing and all of them are accepted, so a new key
+// can be prepended to config.Conf.CookieKeys and the old one removed later.
+func initSignKeys() {
+	signKeys = signKeys[:0]
+	for _, key := range config.Conf.CookieKeys {
+		signKeys = append(signKeys, []byte(key))
+	}
+
+	if len(signKeys) > 0 {
+		return
+	}
+
+	log.Println("WARNING: CookieKeys are not set, using random key: users will be logged out on restart")
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("Could not generate cookie key: " + err.Error())
+	}
+
+	signKeys = append(signKeys, key)
+}
+
+func signature(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns value with appended signature. Signature never contains "." so value can.
+func Sign(value string) string {
+	return value + "." + signature(signKeys[0], value)
+}
+
+// Unsign checks signature of the value produced by Sign and returns the original value
+func Unsign(signed string) (value string, ok bool) {
+	pos := strings.LastIndexByte(signed, '.')
+	if pos < 0 {
+		return "", false
+	}
+
+	value, sig := signed[:pos], signed[pos+1:]
+	for _, key := range signKeys {
+		if hmac.Equal([]byte(sig), []byte(signature(key, value))) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
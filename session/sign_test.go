@@ -0,0 +1,29 @@
+package session
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	signKeys = [][]byte{[]byte("new"), []byte("old")}
+
+	signed := Sign("value")
+	if v, ok := Unsign(signed); !ok || v != "value" {
+		t.Fatalf("Could not unsign %q: got %q, %v", signed, v, ok)
+	}
+
+	if _, ok := Unsign("other" + signed[len("value"):]); ok {
+		t.Fatalf("Tampered value must be rejected")
+	}
+
+	signKeys = [][]byte{[]byte("old")}
+	oldSigned := Sign("value")
+
+	signKeys = [][]byte{[]byte("new"), []byte("old")}
+	if _, ok := Unsign(oldSigned); !ok {
+		t.Fatalf("Value signed with rotated key must be accepted")
+	}
+
+	signKeys = [][]byte{[]byte("new")}
+	if _, ok := Unsign(oldSigned); ok {
+		t.Fatalf("Value signed with removed key must be rejected")
+	}
+}
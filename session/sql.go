@@ -0,0 +1,115 @@
+package session
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+)
+
+const sqlCleanupInterval = 10 * time.Minute
+
+// sqlStore keeps sessions in the kvstore table so that they survive memcache restarts
+type sqlStore struct {
+	getStmt     *sql.Stmt
+	setStmt     *sql.Stmt
+	deleteStmt  *sql.Stmt
+	takeStmt    *sql.Stmt
+	cleanupStmt *sql.Stmt
+	incrStmt    *sql.Stmt
+}
+
+func prepareStmt(db *sql.DB, stmt string) *sql.Stmt {
+	res, err := db.Prepare(stmt)
+	if err != nil {
+		log.Fatal("Could not prepare `" + stmt + "`: " + err.Error())
+	}
+
+	return res
+}
+
+func newSQLStore(db *sql.DB) *sqlStore {
+	s := &sqlStore{
+		getStmt:     prepareStmt(db, `SELECT v FROM kvstore WHERE k = $1 AND (expires = 0 OR expires > $2)`),
+		setStmt:     prepareStmt(db, `UPSERT INTO kvstore(k, v, expires) VALUES($1, $2, $3)`),
+		deleteStmt:  prepareStmt(db, `DELETE FROM kvstore WHERE k = $1`),
+		takeStmt:    prepareStmt(db, `DELETE FROM kvstore WHERE k = $1 AND (expires = 0 OR expires > $2) RETURNING v`),
+		cleanupStmt: prepareStmt(db, `DELETE FROM kvstore WHERE expires <> 0 AND expires < $1`),
+		incrStmt: prepareStmt(db, `INSERT INTO kvstore(k, v, expires) VALUES($1, b'1', $2)
+			ON CONFLICT (k) DO UPDATE SET
+				v = CASE WHEN kvstore.expires <> 0 AND kvstore.expires <= $3 THEN b'1'
+					ELSE convert_to((convert_from(kvstore.v, 'UTF8')::INT + 1)::STRING, 'UTF8') END,
+				expires = $2
+			RETURNING v`),
+	}
+
+	go s.cleanupThread()
+	return s
+}
+
+func (s *sqlStore) cleanupThread() {
+	for range time.Tick(sqlCleanupInterval) {
+		if _, err := s.cleanupStmt.Exec(time.Now().UnixNano()); err != nil {
+			log.Println("Could not clean up expired sessions: ", err.Error())
+		}
+	}
+}
+
+func (s *sqlStore) Get(key string) ([]byte, error) {
+	var value []byte
+
+	err := s.getStmt.QueryRow(key, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *sqlStore) Set(key string, value []byte, ttl time.Duration) error {
+	var expires int64
+	if ttl > 0 {
+		expires = expiresAt(ttl).UnixNano()
+	}
+
+	_, err := s.setStmt.Exec(key, value, expires)
+	return err
+}
+
+func (s *sqlStore) Take(key string) ([]byte, error) {
+	var value []byte
+
+	err := s.takeStmt.QueryRow(key, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *sqlStore) Incr(key string, ttl time.Duration) (int64, error) {
+	var (
+		value   []byte
+		expires int64
+		now     = time.Now()
+	)
+
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+
+	if err := s.incrStmt.QueryRow(key, expires, now.UnixNano()).Scan(&value); err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func (s *sqlStore) Delete(key string) error {
+	_, err := s.deleteStmt.Exec(key)
+	return err
+}
@@ -0,0 +1,33 @@
+package session
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	// Store is a key-value storage for sessions with optional expiration.
+	// Zero ttl means that the key never expires.
+	Store interface {
+		Get(key string) ([]byte, error)
+		Set(key string, value []byte, ttl time.Duration) error
+		Delete(key string) error
+		// Take returns value and deletes the key. When several clients take the same key
+		// concurrently, only one of them gets the value and others get ErrNotFound.
+		Take(key string) ([]byte, error)
+		// Incr atomically adds one to the counter stored under the key and returns the new value.
+		// Missing or expired key counts from zero. ttl is renewed on every call.
+		Incr(key string, ttl time.Duration) (int64, error)
+	}
+)
+
+// ErrNotFound is returned by Store.Get and Store.Take when key is missing or has expired
+var ErrNotFound = errors.New("session: key not found")
+
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
@@ -0,0 +1,86 @@
+package session
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	throttleBaseLockout = time.Minute
+	throttleMaxLockout  = time.Hour
+
+	// Failures are forgotten after this much time without new ones
+	throttleWindow = 24 * time.Hour
+)
+
+// Throttle counts failed attempts per key (e.g. ip or email) and locks the key
+// out for exponentially growing time once there are more than Threshold failures
+type Throttle struct {
+	Prefix    string
+	Threshold int
+}
+
+func (t *Throttle) key(key string) string {
+	return "throttle_" + t.Prefix + "_" + key
+}
+
+// Lock key holds the time when lockout ends and expires together with the lockout
+func (t *Throttle) lockKey(key string) string {
+	return t.key(key) + "_locked"
+}
+
+// LockedFor returns how long the key stays locked out, zero means it is not locked
+func (t *Throttle) LockedFor(key string) (time.Duration, error) {
+	contents, err := store.Get(t.lockKey(key))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	lockedUntil, err := strconv.ParseInt(string(contents), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if d := time.Until(time.Unix(0, lockedUntil)); d > 0 {
+		return d, nil
+	}
+
+	return 0, nil
+}
+
+// Fail records failed attempt and returns lockout duration if the key got locked out.
+// Failures are counted atomically, so concurrent attempts cannot get past the threshold.
+// Concurrent failures may overwrite each other's lockout, but the key gets locked either way.
+func (t *Throttle) Fail(key string) (time.Duration, error) {
+	failures, err := store.Incr(t.key(key), throttleWindow)
+	if err != nil {
+		return 0, err
+	}
+
+	if failures <= int64(t.Threshold) {
+		return 0, nil
+	}
+
+	lockout := throttleBaseLockout
+	for i := int64(t.Threshold) + 1; i < failures && lockout < throttleMaxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > throttleMaxLockout {
+		lockout = throttleMaxLockout
+	}
+
+	lockedUntil := time.Now().Add(lockout).UnixNano()
+	return lockout, store.Set(t.lockKey(key), []byte(strconv.FormatInt(lockedUntil, 10)), lockout)
+}
+
+// Reset forgets all failed attempts for the key
+func (t *Throttle) Reset(key string) error {
+	if err := store.Delete(t.key(key)); err != nil {
+		return err
+	}
+
+	return store.Delete(t.lockKey(key))
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	store = &memoryStore{items: make(map[string]memoryItem)}
+	th := &Throttle{Prefix: "test", Threshold: 2}
+
+	for i := 0; i < 2; i++ {
+		if lockout, err := th.Fail("key"); err != nil || lockout != 0 {
+			t.Fatalf("Unexpected lockout before threshold: %s, %v", lockout, err)
+		}
+	}
+
+	if d, _ := th.LockedFor("key"); d != 0 {
+		t.Fatalf("Key must not be locked before threshold, got %s", d)
+	}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for _, exp := range expected {
+		if lockout, err := th.Fail("key"); err != nil || lockout != exp {
+			t.Fatalf("Unexpected lockout: got %s, expected %s (err %v)", lockout, exp, err)
+		}
+	}
+
+	if d, _ := th.LockedFor("key"); d <= 0 {
+		t.Fatalf("Key must be locked after threshold")
+	}
+
+	th.Reset("key")
+	if d, _ := th.LockedFor("key"); d != 0 {
+		t.Fatalf("Key must not be locked after reset, got %s", d)
+	}
+}
+
+func TestThrottleConcurrent(t *testing.T) {
+	store = &memoryStore{items: make(map[string]memoryItem)}
+	th := &Throttle{Prefix: "test", Threshold: 5}
+
+	const attempts = 50
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		locked int
+	)
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lockout, err := th.Fail("key")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if lockout > 0 {
+				mu.Lock()
+				locked++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if locked != attempts-th.Threshold {
+		t.Fatalf("Every failure after threshold must lock the key: got %d lockouts, expected %d", locked, attempts-th.Threshold)
+	}
+
+	if d, _ := th.LockedFor("key"); d <= 0 {
+		t.Fatalf("Key must be locked after concurrent failures")
+	}
+}
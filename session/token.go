@@ -0,0 +1,38 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const tokenBytes = 32
+
+// Only hash of the token is used as a key, so leaked store contents cannot be used
+// to redeem tokens
+func tokenKey(kind, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token_" + kind + "_" + hex.EncodeToString(sum[:])
+}
+
+// CreateToken stores value under a new random token that can be used once within ttl
+func CreateToken(kind string, value []byte, ttl time.Duration) (token string, err error) {
+	buf := make([]byte, tokenBytes)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	token = hex.EncodeToString(buf)
+	if err = store.Set(tokenKey(kind, token), value, ttl); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ConsumeToken returns value stored by CreateToken and invalidates the token.
+// Only one of concurrent calls with the same token succeeds, others get ErrNotFound.
+func ConsumeToken(kind, token string) ([]byte, error) {
+	return store.Take(tokenKey(kind, token))
+}
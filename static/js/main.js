@@ -122,9 +122,19 @@ function showNotification(msg) {
 	setTimeout(function() { el.style.display = 'none' }, 5000)
 }
 
+var lastEventId = ''
+
+function updateLastEventId(id) {
+	if (id && (lastEventId == '' || Number(id) > Number(lastEventId))) {
+		lastEventId = id
+	}
+}
+
 function onMessage(evt) {
 	var reply = JSON.parse(evt.data)
+	updateLastEventId(reply.EventId)
 	if (reply.Type == 'EVENT_ONLINE_USERS_LIST') {
+		updateLastEventId(reply.LastEventId)
 		for (var i = 0; i < reply.Users.length; i++) {
 			onUserConnect(reply.Users[i])
 		}
@@ -140,6 +150,12 @@ function onMessage(evt) {
 	    showNotification("User wants to add you to friends")
         friendsRequestsCount++
         redrawFriendsRequestCount()
+	} else if (reply.Type == 'EVENT_SESSION_REVOKED') {
+		window.location = '/'
+	} else if (reply.Type == 'EVENT_PING') {
+		websocket.send("REQUEST_PONG 0\n{}")
+	} else if (reply.Type == 'EVENT_RESYNC') {
+		window.location.reload()
 	} else {
 		if (!rcvCallbacks[reply.SeqId]) {
 			console.log("Received response for missing seqid")
@@ -191,7 +207,7 @@ function redrawUsers() {
 
 function setWebsocketConnection() {
 	rcvCallbacks = {}
-	websocket = new WebSocket("ws" + (window.location.protocol.indexOf("https") >= 0 ? "s" : "") + "://" + window.location.host + "/events")
+	websocket = new WebSocket("ws" + (window.location.protocol.indexOf("https") >= 0 ? "s" : "") + "://" + window.location.host + "/events" + (lastEventId ? "?last_event_id=" + lastEventId : ""))
 	websocket.onopen = function(evt) {
 		connected = true
 		updateConnectionStatus()
@@ -1,3 +1,5 @@
+-- Schema for new installations, existing databases are upgraded by applying migrations/*.sql in order
+
 CREATE TABLE friend (
   id SERIAL PRIMARY KEY,
   user_id BIGINT,
@@ -31,9 +33,24 @@ CREATE TABLE socialuser (
   password VARCHAR(80),
   name VARCHAR(255),
   have_avatar BOOL,
+  email_verified BOOL DEFAULT true,
+  totp_secret VARCHAR(64) DEFAULT '',
+  totp_enabled BOOL DEFAULT false,
+  totp_last_step BIGINT DEFAULT 0,
+  delete_after BIGINT DEFAULT 0,
   UNIQUE (email)
 );
 
+-- Emails are stored lowercased, this catches anything that bypasses validate.Email
+CREATE UNIQUE INDEX socialuser_lower_email_key ON socialuser ((lower(email)));
+
+CREATE TABLE recoverycode (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  code_hash VARCHAR(64),
+  INDEX(user_id, code_hash)
+);
+
 CREATE TABLE userinfo (
   user_id INT NOT NULL PRIMARY KEY,
   name VARCHAR(255),
@@ -65,3 +82,31 @@ CREATE TABLE hashtimeline (
   ts BIGINT,
   INDEX(hash_id, ts)
 );
+
+CREATE TABLE kvstore (
+  k VARCHAR(255) PRIMARY KEY,
+  v BYTES,
+  expires BIGINT,
+  INDEX(expires)
+);
+
+CREATE TABLE securityevent (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  event_type VARCHAR(64),
+  ip VARCHAR(64),
+  ts BIGINT,
+  INDEX(user_id, ts)
+);
+
+CREATE TABLE apitoken (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT,
+  name VARCHAR(255),
+  token_hash VARCHAR(64),
+  scopes VARCHAR(1024),
+  created_ts BIGINT,
+  last_used_ts BIGINT,
+  UNIQUE (token_hash),
+  INDEX(user_id)
+);
@@ -5,5 +5,12 @@ import (
 )
 
 var (
-	authTpl = template.Must(template.ParseFiles("static/auth.html"))
+	indexTpl         = template.Must(template.ParseFiles("static/index.html"))
+	authTpl          = template.Must(template.ParseFiles("static/auth.html"))
+	registerTpl      = template.Must(template.ParseFiles("static/register.html"))
+	resetPasswordTpl = template.Must(template.ParseFiles("static/reset-password.html"))
+
+	forgotPasswordTpl     = template.Must(template.ParseFiles("static/forgot-password.html"))
+	resendVerificationTpl = template.Must(template.ParseFiles("static/resend-verification.html"))
+	loginTotpTpl          = template.Must(template.ParseFiles("static/login-totp.html"))
 )
@@ -0,0 +1,103 @@
+// Package totp implements time-based one-time passwords as described in RFC 6238
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	secretBytes = 20
+	digits      = 6
+	period      = 30
+
+	// Number of periods before and after current time during which a code is still
+	// accepted to tolerate clock skew
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns new random secret in base32 as expected by authenticator apps
+func GenerateSecret() (string, error) {
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(buf), nil
+}
+
+// URI returns otpauth:// URI that is usually shown as a QR code
+func URI(secret, issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// Code returns the code for the given time
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, uint64(t.Unix())/period, digits), nil
+}
+
+// Validate checks code against the secret allowing small clock skew
+func Validate(secret, code string, t time.Time) bool {
+	_, ok := ValidateStep(secret, code, t)
+	return ok
+}
+
+// ValidateStep is like Validate, but also returns the time step that the code is for,
+// so that callers can reject codes that were already used
+func ValidateStep(secret, code string, t time.Time) (step uint64, ok bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != digits {
+		return 0, false
+	}
+
+	counter := uint64(t.Unix()) / period
+	for i := counter - skew; i <= counter+skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, i, digits)), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,54 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors for SHA1 from RFC 6238 Appendix B
+func TestHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		ts   int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		if code := hotp(key, uint64(tt.ts)/period, 8); code != tt.code {
+			t.Fatalf("Invalid code for ts=%d: got %s, expected %s", tt.ts, code, tt.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Could not generate secret: %s", err.Error())
+	}
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatalf("Could not generate code: %s", err.Error())
+	}
+
+	if !Validate(secret, code, now.Add(period*time.Second)) {
+		t.Fatalf("Code from previous period must be accepted")
+	}
+
+	if Validate(secret, code, now.Add(3*period*time.Second)) {
+		t.Fatalf("Code from too long ago must be rejected")
+	}
+
+	if step, ok := ValidateStep(secret, code, now.Add(period*time.Second)); !ok || step != uint64(now.Unix())/period {
+		t.Fatalf("Unexpected time step for code from previous period: %d, %v", step, ok)
+	}
+}
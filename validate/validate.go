@@ -0,0 +1,89 @@
+// Package validate checks user input shared by registration and account settings
+package validate
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength     = 64
+	minPasswordLength = 8
+
+	// bcrypt ignores everything after 72 bytes
+	maxPasswordBytes = 72
+)
+
+// Email checks email syntax and returns it in the form it is stored in db,
+// so that "A@x.org" and "a@x.org" are the same user
+func Email(email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", errors.New("Email address is not valid")
+	}
+
+	return strings.ToLower(email), nil
+}
+
+func Name(name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return "", errors.New("Name must not be empty")
+	} else if utf8.RuneCountInString(name) > maxNameLength {
+		return "", errors.New("Name is too long")
+	}
+
+	for _, c := range name {
+		if !unicode.IsPrint(c) {
+			return "", errors.New("Name contains invalid characters")
+		}
+	}
+
+	return name, nil
+}
+
+// Password checks that password is long enough and contains at least two of: letters, digits and other symbols
+func Password(password string, personal ...string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return errors.New("Password must be at least 8 characters long")
+	} else if len(password) > maxPasswordBytes {
+		return errors.New("Password is too long")
+	}
+
+	var hasLetter, hasDigit, hasOther bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{hasLetter, hasDigit, hasOther} {
+		if has {
+			classes++
+		}
+	}
+
+	if classes < 2 {
+		return errors.New("Password must contain at least two of: letters, digits and other symbols")
+	}
+
+	for _, s := range personal {
+		if s != "" && strings.EqualFold(password, s) {
+			return errors.New("Password must not be the same as your name or email")
+		}
+	}
+
+	return nil
+}
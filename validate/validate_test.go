@@ -0,0 +1,37 @@
+package validate
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	valid := map[string]string{
+		"a@x.org":       "a@x.org",
+		" A@X.org ":     "a@x.org",
+		"Some.One@x.ru": "some.one@x.ru",
+	}
+
+	for in, exp := range valid {
+		if res, err := Email(in); err != nil || res != exp {
+			t.Fatalf("Unexpected result for %q: got %q, %v; expected %q", in, res, err, exp)
+		}
+	}
+
+	for _, in := range []string{"", "a", "a@", "Name <a@x.org>", "a@x.org, b@x.org"} {
+		if _, err := Email(in); err == nil {
+			t.Fatalf("Email %q must be invalid", in)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	for _, p := range []string{"short1", "onlyletters", "12345678", "Yuriy1234"} {
+		if err := Password(p, "yuriy1234"); err == nil {
+			t.Fatalf("Password %q must be rejected", p)
+		}
+	}
+
+	for _, p := range []string{"letters123", "пароль-длинный"} {
+		if err := Password(p, "yuriy1234"); err != nil {
+			t.Fatalf("Password %q must be accepted: %s", p, err.Error())
+		}
+	}
+}